@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// accountingCases are login sequences of one account with capacity 3 and
+// the attempts left and failures counted after them. A right password
+// refunds the attempt it took and the failures before it; once the bucket
+// is empty even the right one is denied.
+var accountingCases = []struct {
+	name     string
+	logins   []bool
+	left     int
+	denied   int
+	failures int
+}{
+	{"right password", []bool{true}, 3, 0, 0},
+	{"mistyped twice", []bool{false, false}, 1, 0, 2},
+	{"mistyped twice, then right", []bool{false, false, true}, 3, 0, 0},
+	{"mistyped after a success", []bool{false, true, false, false}, 1, 0, 2},
+	{"guessed out", []bool{false, false, false, false}, 0, 1, 3},
+	{"right password after guessed out", []bool{false, false, false, true}, 0, 1, 3},
+	{"guessed out after a refund", []bool{false, false, true, false, false, false, true}, 0, 1, 3},
+}
+
+// TestAccounting runs accountingCases against a fresh attempt log. The
+// lockout only counts the failures, it never locks within three attempts.
+func TestAccounting(t *testing.T) {
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := parseLockoutSpec("after=4,delay=15m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := bucketLimits{Capacity: 3, Refill: time.Hour}
+	attempts := newAttemptLog(newMemoryStore(), &sealedState{Sealer: &softwareSealer{key: key}, counter: &memoryCounter{}}, limits, lockout, 1)
+	for i, c := range accountingCases {
+		t.Run(c.name, func(t *testing.T) {
+			saltKey := fmt.Sprintf("case%d", i)
+			if err := attempts.fill(saltKey); err != nil {
+				t.Fatal(err)
+			}
+			denied := 0
+			for _, right := range c.logins {
+				_, err := attempts.take(saltKey)
+				if err == errNoAttempts {
+					denied++
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if right {
+					if err := attempts.refund(saltKey); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			status, err := attempts.status(saltKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Tokens != c.left || denied != c.denied || status.Failures != c.failures {
+				t.Errorf("%d attempts left, %d denied and %d failures, expected %d, %d and %d",
+					status.Tokens, denied, status.Failures, c.left, c.denied, c.failures)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// adminPageSize is the number of records read at once when scanning all users
+const adminPageSize = 500
+
+// requireAdmin only lets requests through that carry the admin token as
+// "Authorization: Bearer <token>". Only the hash of the token is
+// configured, as the measured config can be read by the host; the hash of
+// the given token is compared with it. Without a configured hash all admin
+// endpoints are disabled.
+func requireAdmin(adminTokenHash string, next http.HandlerFunc) http.HandlerFunc {
+	// Validate checked the hash
+	expected, _ := hex.DecodeString(adminTokenHash)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(expected) == 0 {
+			http.Error(w, "Admin endpoints are disabled", http.StatusForbidden)
+			return
+		}
+		given := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+		if subtle.ConstantTimeCompare(given[:], expected) != 1 {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// rotationStatus reports how far the records have moved to the current key.
+// Records counts the records per outermost key, the key needed to test
+// guesses against them; Needed counts the records that need a key at any
+// layer of their wrap chain to verify.
+type rotationStatus struct {
+	Current string         `json:"current"`
+	Keys    []string       `json:"keys"`
+	Records map[string]int `json:"records"`
+	Needed  map[string]int `json:"needed"`
+	Pending int            `json:"pending"`
+	Invalid int            `json:"invalid"`
+	Wrap    *wrapProgress  `json:"wrap,omitempty"`
+}
+
+// keyUsage counts the records per hmac key generation.
+func keyUsage(keys *keyRing, database UserStore) (rotationStatus, error) {
+	current, _ := keys.currentKey()
+	status := rotationStatus{Current: current, Keys: keys.generations(), Records: make(map[string]int), Needed: make(map[string]int)}
+	after := ""
+	for {
+		page, err := database.ListRecords(after, adminPageSize)
+		if err != nil {
+			return rotationStatus{}, err
+		}
+		for _, user := range page {
+			record, err := parseRecord(user.Hmac, user.Salt)
+			if err != nil {
+				status.Invalid++
+				continue
+			}
+			status.Records[record.outerKeyID()]++
+			for _, kid := range record.keyIDs() {
+				status.Needed[kid]++
+			}
+			if record.outerKeyID() != current {
+				status.Pending++
+			}
+		}
+		if len(page) < adminPageSize {
+			return status, nil
+		}
+		after = page[len(page)-1].Username
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// keyStatusHandler reports the key generations, how many records each
+// one still protects and the progress of the last wrap run.
+func keyStatusHandler(keys *keyRing, database UserStore, job *wrapJob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := keyUsage(keys, database)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to read records", http.StatusInternalServerError)
+			return
+		}
+		if progress := job.status(); !progress.Started.IsZero() {
+			status.Wrap = &progress
+		}
+		writeJSON(w, status)
+	}
+}
+
+// keyRotateHandler generates a new hmac key generation, which becomes
+// current once the ring is sealed and stored. Records move to the new key
+// when their user logs in.
+func keyRotateHandler(keys *keyRing, database Store, state *sealedState, job *wrapJob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		kid, err := keys.rotate(ringSaver(database, state))
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to generate and store a new key", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🔑 Rotated hmac key to generation %s\n", kid)
+		keyStatusHandler(keys, database, job)(w, r)
+	}
+}
+
+// keyRetireHandler destroys an old key generation given by the kid query
+// parameter. It refuses while any record still needs the key at any layer:
+// a wrapped record is only verified through its innermost key, so a wrap
+// run alone never frees a generation.
+func keyRetireHandler(keys *keyRing, database Store, state *sealedState, job *wrapJob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		kid := r.URL.Query().Get("kid")
+		status, err := keyUsage(keys, database)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to read records", http.StatusInternalServerError)
+			return
+		}
+		if n := status.Needed[kid]; n > 0 {
+			http.Error(w, fmt.Sprintf("%d records still need hmac key %s, their users have to log in or be removed first", n, kid), http.StatusConflict)
+			return
+		}
+		if current, _ := keys.currentKey(); kid == current {
+			http.Error(w, "the current hmac key cannot be retired", http.StatusBadRequest)
+			return
+		}
+		if _, err := keys.key(kid); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := keys.retire(kid, ringSaver(database, state)); err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to store the key ring", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🔑 Retired hmac key generation %s\n", kid)
+		keyStatusHandler(keys, database, job)(w, r)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRequireAdmin checks that the bearer token is compared through its
+// hash and that the endpoints are disabled without one.
+func TestRequireAdmin(t *testing.T) {
+	sum := sha256.Sum256([]byte("admin secret"))
+	hash := hex.EncodeToString(sum[:])
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, c := range []struct {
+		hash   string
+		header string
+		status int
+	}{
+		{hash, "Bearer admin secret", http.StatusOK},
+		{hash, "Bearer " + hash, http.StatusUnauthorized},
+		{hash, "Bearer admin", http.StatusUnauthorized},
+		{hash, "", http.StatusUnauthorized},
+		{"", "Bearer admin secret", http.StatusForbidden},
+		{"", "", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest("GET", "/admin/keys", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		requireAdmin(c.hash, ok)(w, r)
+		if w.Code != c.status {
+			t.Errorf("hash %q, header %q: status %d, want %d", c.hash, c.header, w.Code, c.status)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.AdminToken = "admin secret"
+	if cfg.Validate() == nil {
+		t.Error("a plaintext adminToken is accepted")
+	}
+	cfg = defaultConfig()
+	cfg.AdminTokenHash = "admin secret"
+	if cfg.Validate() == nil {
+		t.Error("an adminTokenHash that is no SHA-256 is accepted")
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// compactEvery is the number of attempt log entries after which the
+// changed partitions are sealed in a checkpoint and the log truncated
+const compactEvery = 1000
+
+// attemptPartitions is the number of sealed rows the buckets are split
+// into by salt. A row holds only the buckets that differ from a full one.
+const attemptPartitions = 1 << 14
+
+// attemptShards is the number of locks the partitions are split over, so
+// logins of different accounts only wait for each other to append to the
+// attempt log
+const attemptShards = 64
+
+// attemptEntry is one sealed change of salt_with_attempt. Seq numbers the
+// entries without gaps, so the host can neither reorder nor drop entries
+// from the middle of the log.
+type attemptEntry struct {
+	Seq      int64      `json:"seq"`
+	Salt     string     `json:"salt,omitempty"`
+	Attempts int        `json:"attempts"`
+	Refilled *time.Time `json:"refilled,omitempty"`
+	Failures int        `json:"failures,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Locked   *time.Time `json:"locked,omitempty"`
+	// Reset was logged for the daily reset of every counter to Attempts
+	// before the token buckets; such entries are still replayed
+	Reset *time.Time `json:"reset,omitempty"`
+}
+
+// attemptSnapshot is the sealed index of the partitions. Seq is the last
+// log entry it includes and Partitions holds, per partition, the state
+// version of the checkpoint that last wrote its row, 0 for an empty one.
+// Releases before the partitions sealed every bucket in Buckets, releases
+// before the token buckets the attempts left per salt in Attempts, and
+// releases before the attempt log sealed that bare map, read as seq 0.
+type attemptSnapshot struct {
+	Seq        int64             `json:"seq"`
+	Partitions []uint64          `json:"partitions,omitempty"`
+	Buckets    map[string]bucket `json:"buckets,omitempty"`
+	Attempts   map[string]int    `json:"attempts,omitempty"`
+}
+
+// attemptPartition is the sealed row of one partition.
+type attemptPartition struct {
+	ID      int               `json:"id"`
+	Buckets map[string]bucket `json:"buckets"`
+}
+
+// partition is a partition held in memory. A dirty one has changes that
+// are only in the attempt log; it stays until the next checkpoint.
+type partition struct {
+	id      int
+	buckets map[string]bucket
+	dirty   bool
+	elem    *list.Element
+}
+
+// attemptShard holds the partitions of its lock that are in memory, most
+// recently used first.
+type attemptShard struct {
+	mu         sync.Mutex
+	partitions map[int]*partition
+	lru        *list.List
+}
+
+// attemptLog makes every change of salt_with_attempt durable before it
+// takes effect: the change is sealed and appended to the attempt log, and
+// initialize replays the log on top of the last checkpoint. A crash
+// therefore cannot give anyone fresh guesses.
+//
+// Only buckets that differ from a full one are kept, in sealed partition
+// rows that are loaded on demand; at most cache clean partitions per shard
+// stay in memory. A partition row must have exactly the version the
+// sealed index names, so the host cannot roll back a single row either.
+//
+// A change holds the lock of its shard and then mu, which orders the log;
+// a checkpoint holds every shard lock and then mu, so it sees no change
+// half done.
+type attemptLog struct {
+	shards   [attemptShards]attemptShard
+	mu       sync.Mutex
+	database StateStore
+	state    *sealedState
+	limits   bucketLimits
+	lockout  *lockoutSpec
+	cache    int
+	versions []uint64
+	seq      int64
+	appended int
+}
+
+// newAttemptLog returns an attempt log in which every bucket is full. cache
+// is the number of clean partitions kept in memory.
+func newAttemptLog(database StateStore, state *sealedState, limits bucketLimits, lockout *lockoutSpec, cache int) *attemptLog {
+	l := &attemptLog{database: database, state: state, limits: limits, lockout: lockout, versions: make([]uint64, attemptPartitions)}
+	l.cache = cache / attemptShards
+	if l.cache < 1 {
+		l.cache = 1
+	}
+	for i := range l.shards {
+		l.shards[i].partitions = make(map[int]*partition)
+		l.shards[i].lru = list.New()
+	}
+	return l
+}
+
+// locate returns the shard and the partition of a salt.
+func (l *attemptLog) locate(saltKey string) (*attemptShard, int) {
+	h := fnv.New32a()
+	h.Write([]byte(saltKey))
+	id := int(h.Sum32() % attemptPartitions)
+	return &l.shards[id%attemptShards], id
+}
+
+// partition returns a partition, loading its sealed row if it is not in
+// memory. The caller holds the lock of the shard.
+func (l *attemptLog) partition(shard *attemptShard, id int) (*partition, error) {
+	if p, ok := shard.partitions[id]; ok {
+		shard.lru.MoveToFront(p.elem)
+		return p, nil
+	}
+	buckets, err := l.load(id)
+	if err != nil {
+		return nil, err
+	}
+	p := &partition{id: id, buckets: buckets}
+	p.elem = shard.lru.PushFront(p)
+	shard.partitions[id] = p
+	l.evict(shard)
+	return p, nil
+}
+
+// load unseals the row of a partition and checks it against the index.
+func (l *attemptLog) load(id int) (map[string]bucket, error) {
+	version := l.versions[id]
+	if version == 0 {
+		return make(map[string]bucket), nil
+	}
+	sealed, err := l.database.GetAttemptPartition(id)
+	if err == ErrNotFound {
+		return nil, fmt.Errorf("attempt partition %d is missing", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, envelope, err := l.state.open(statePartition, sealed)
+	if err != nil {
+		return nil, err
+	}
+	if envelope.Version != version {
+		return nil, fmt.Errorf("attempt partition %d has version %d but the index names %d, refusing a stale partition", id, envelope.Version, version)
+	}
+	var row attemptPartition
+	if err := json.Unmarshal(data, &row); err != nil {
+		return nil, err
+	}
+	if row.ID != id {
+		return nil, fmt.Errorf("attempt partition %d found in the row of partition %d", row.ID, id)
+	}
+	if row.Buckets == nil {
+		row.Buckets = make(map[string]bucket)
+	}
+	return row.Buckets, nil
+}
+
+// evict drops the least recently used clean partitions of a shard beyond
+// the cache size, but never the one used last.
+func (l *attemptLog) evict(shard *attemptShard) {
+	for e := shard.lru.Back(); e != nil && e != shard.lru.Front() && len(shard.partitions) > l.cache; {
+		prev := e.Prev()
+		if p := e.Value.(*partition); !p.dirty {
+			shard.lru.Remove(e)
+			delete(shard.partitions, p.id)
+		}
+		e = prev
+	}
+}
+
+// loadLegacy takes the buckets of a snapshot from before the partitions,
+// including the log up to seq. They are all dirty until the checkpoint
+// that initialize takes right away.
+func (l *attemptLog) loadLegacy(buckets map[string]bucket, seq int64) {
+	for saltKey, b := range buckets {
+		shard, id := l.locate(saltKey)
+		p, ok := shard.partitions[id]
+		if !ok {
+			p = &partition{id: id, buckets: make(map[string]bucket), dirty: true}
+			p.elem = shard.lru.PushFront(p)
+			shard.partitions[id] = p
+		}
+		p.buckets[saltKey] = b
+	}
+	l.seq = seq
+}
+
+// take removes one attempt from the bucket of a salt, after refilling it,
+// counts it as a failure for the lockout and returns the bucket. It
+// returns errLocked if the account is locked and errNoAttempts if the
+// bucket is empty.
+func (l *attemptLog) take(saltKey string) (bucket, error) {
+	return l.change(saltKey, func(b bucket, now time.Time) (bucket, error) {
+		if b.locked(now) {
+			return b, errLocked
+		}
+		b = b.refill(l.limits, now)
+		if b.Tokens == 0 {
+			return b, errNoAttempts
+		}
+		b.Tokens--
+		if l.lockout != nil {
+			b = l.lockout.fail(b, now)
+		}
+		return b, nil
+	})
+}
+
+// fill logs and applies a full bucket for a new salt.
+func (l *attemptLog) fill(saltKey string) error {
+	_, err := l.change(saltKey, func(b bucket, now time.Time) (bucket, error) {
+		return l.limits.fullBucket(now), nil
+	})
+	return err
+}
+
+// refund restores the full bucket of a salt after a successful login and
+// clears its failures, so mistyped passwords before it cost nothing. A
+// full bucket without failures is left alone and nothing is logged.
+func (l *attemptLog) refund(saltKey string) error {
+	_, err := l.change(saltKey, func(b bucket, now time.Time) (bucket, error) {
+		if b.refill(l.limits, now).full(l.limits) {
+			return b, errBucketFull
+		}
+		return l.limits.fullBucket(now), nil
+	})
+	if err == errBucketFull {
+		return nil
+	}
+	return err
+}
+
+// unlock clears the lock of a salt and restores its full bucket. With
+// locked set it only clears the hard lock of that time, and returns
+// errUnlockUsed otherwise.
+func (l *attemptLog) unlock(saltKey string, locked *time.Time) error {
+	_, err := l.change(saltKey, func(b bucket, now time.Time) (bucket, error) {
+		if locked != nil && (b.Locked == nil || !b.Locked.Equal(*locked)) {
+			return b, errUnlockUsed
+		}
+		return l.limits.fullBucket(now), nil
+	})
+	return err
+}
+
+// status returns the refilled bucket of a salt.
+func (l *attemptLog) status(saltKey string) (bucketStatus, error) {
+	shard, id := l.locate(saltKey)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	p, err := l.partition(shard, id)
+	if err != nil {
+		return bucketStatus{}, err
+	}
+	now := time.Now()
+	b, ok := p.buckets[saltKey]
+	if !ok {
+		b = l.limits.fullBucket(now)
+	}
+	return b.status(l.limits, now), nil
+}
+
+// change computes the next bucket of a salt from the current one, a full
+// one if none is stored, under the lock of its shard, and logs and
+// applies it unless next fails.
+func (l *attemptLog) change(saltKey string, next func(b bucket, now time.Time) (bucket, error)) (bucket, error) {
+	shard, id := l.locate(saltKey)
+	shard.mu.Lock()
+	p, err := l.partition(shard, id)
+	if err != nil {
+		shard.mu.Unlock()
+		return bucket{}, err
+	}
+	now := time.Now()
+	b, ok := p.buckets[saltKey]
+	if !ok {
+		b = l.limits.fullBucket(now)
+	}
+	b, err = next(b, now)
+	if err == nil {
+		err = l.apply(p, saltKey, b)
+	}
+	shard.mu.Unlock()
+	if err == nil {
+		l.compact()
+	}
+	return b, err
+}
+
+func (l *attemptLog) apply(p *partition, saltKey string, b bucket) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	refilled := b.Refilled
+	entry := attemptEntry{Salt: saltKey, Attempts: b.Tokens, Refilled: &refilled, Failures: b.Failures, Until: b.Until, Locked: b.Locked}
+	if err := l.append(entry); err != nil {
+		return err
+	}
+	l.set(p, saltKey, b)
+	return nil
+}
+
+// set stores a bucket in its partition; a full one is not stored.
+func (l *attemptLog) set(p *partition, saltKey string, b bucket) {
+	if b.full(l.limits) {
+		delete(p.buckets, saltKey)
+	} else {
+		p.buckets[saltKey] = b
+	}
+	p.dirty = true
+}
+
+// snapshot seals a checkpoint and drops the log entries it includes.
+func (l *attemptLog) snapshot() error {
+	l.lockAll()
+	defer l.unlockAll()
+	return l.checkpoint()
+}
+
+func (l *attemptLog) lockAll() {
+	for i := range l.shards {
+		l.shards[i].mu.Lock()
+	}
+	l.mu.Lock()
+}
+
+func (l *attemptLog) unlockAll() {
+	l.mu.Unlock()
+	for i := len(l.shards) - 1; i >= 0; i-- {
+		l.shards[i].mu.Unlock()
+	}
+}
+
+// checkpoint seals the dirty partitions and the index in one transaction;
+// the caller holds every lock. Buckets that are full again are dropped; a
+// bucket with failures or a lock is kept, phantom or not, so a probe of an
+// unknown username counts towards the lockout like a wrong password.
+func (l *attemptLog) checkpoint() error {
+	now := time.Now()
+	var dirty []*partition
+	for i := range l.shards {
+		for _, p := range l.shards[i].partitions {
+			if !p.dirty {
+				continue
+			}
+			for saltKey, b := range p.buckets {
+				b = b.refill(l.limits, now)
+				if b.full(l.limits) {
+					delete(p.buckets, saltKey)
+				}
+			}
+			dirty = append(dirty, p)
+		}
+	}
+	err := l.state.updateAt(stateAttempts, func(version uint64, seal sealFunc) error {
+		versions := append([]uint64(nil), l.versions...)
+		rows := make(map[int][]byte)
+		for _, p := range dirty {
+			if len(p.buckets) == 0 {
+				// an empty partition needs no row
+				versions[p.id], rows[p.id] = 0, nil
+				continue
+			}
+			data, err := json.Marshal(attemptPartition{ID: p.id, Buckets: p.buckets})
+			if err != nil {
+				return err
+			}
+			if rows[p.id], err = seal(statePartition, data); err != nil {
+				return err
+			}
+			versions[p.id] = version
+		}
+		data, err := json.Marshal(attemptSnapshot{Seq: l.seq, Partitions: versions})
+		if err != nil {
+			return err
+		}
+		index, err := seal(stateAttempts, data)
+		if err != nil {
+			return err
+		}
+		if err := l.database.PutAttemptCheckpoint(index, rows, l.seq); err != nil {
+			return err
+		}
+		l.versions = versions
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range dirty {
+		p.dirty = false
+	}
+	for i := range l.shards {
+		l.evict(&l.shards[i])
+	}
+	l.appended = 0
+	return nil
+}
+
+func (l *attemptLog) append(entry attemptEntry) error {
+	entry.Seq = l.seq + 1
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	err = l.state.update(stateLogEntry, func(seal sealFunc) error {
+		sealed, err := seal(stateLogEntry, data)
+		if err != nil {
+			return err
+		}
+		return l.database.AppendAttemptLog(entry.Seq, sealed)
+	})
+	if err != nil {
+		return err
+	}
+	l.seq = entry.Seq
+	l.appended++
+	return nil
+}
+
+// compact takes a checkpoint once enough entries were appended. The
+// changes are already durable in the log, so a failure is only reported.
+func (l *attemptLog) compact() {
+	l.mu.Lock()
+	due := l.appended >= compactEvery
+	l.mu.Unlock()
+	if !due {
+		return
+	}
+	l.lockAll()
+	defer l.unlockAll()
+	// another change may have compacted in the meantime
+	if l.appended < compactEvery {
+		return
+	}
+	if err := l.checkpoint(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// replay applies the log entries after the checkpoint, loading the
+// partitions they change, and returns the envelope of the last one, or
+// that of the checkpoint if the log is empty. It refuses a log with
+// missing or reordered entries. It runs before the handlers start and
+// takes no locks.
+func (l *attemptLog) replay(snapshot stateEnvelope) (stateEnvelope, error) {
+	last := snapshot
+	entries, err := l.database.GetAttemptLog(l.seq)
+	if err != nil {
+		return last, err
+	}
+	for _, sealed := range entries {
+		data, envelope, err := l.state.open(stateLogEntry, sealed)
+		if err != nil {
+			return last, err
+		}
+		var entry attemptEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return last, err
+		}
+		if entry.Seq != l.seq+1 {
+			return last, fmt.Errorf("attempt log entry %d follows entry %d", entry.Seq, l.seq)
+		}
+		// entries from before the envelope all have version 0
+		if envelope.Version <= last.Version && envelope.Version != 0 {
+			return last, fmt.Errorf("attempt log entry %d is not newer than the state before it", entry.Seq)
+		}
+		last = envelope
+		// entries from before the token buckets start refilling now
+		refilled := time.Now()
+		if entry.Refilled != nil {
+			refilled = *entry.Refilled
+		}
+		if entry.Reset != nil {
+			// only logged before the partitions, so every bucket is in memory
+			for i := range l.shards {
+				for _, p := range l.shards[i].partitions {
+					for salt := range p.buckets {
+						l.set(p, salt, bucket{Tokens: entry.Attempts, Refilled: refilled})
+					}
+				}
+			}
+		} else {
+			shard, id := l.locate(entry.Salt)
+			p, err := l.partition(shard, id)
+			if err != nil {
+				return last, err
+			}
+			l.set(p, entry.Salt, bucket{Tokens: entry.Attempts, Refilled: refilled, Failures: entry.Failures, Until: entry.Until, Locked: entry.Locked})
+		}
+		l.seq = entry.Seq
+		l.appended++
+	}
+	if len(entries) > 0 {
+		fmt.Printf("🆗 Replayed %d attempt log entries.\n", len(entries))
+	}
+	return last, nil
+}
+
+// resetAttempts seals an index without partitions, which gives every
+// account a full bucket, and drops the attempt log.
+func resetAttempts(database StateStore, state *sealedState) error {
+	return state.update(stateAttempts, func(seal sealFunc) error {
+		data, err := json.Marshal(attemptSnapshot{Partitions: make([]uint64, attemptPartitions)})
+		if err != nil {
+			return err
+		}
+		index, err := seal(stateAttempts, data)
+		if err != nil {
+			return err
+		}
+		return database.PutAttemptCheckpoint(index, nil, math.MaxInt64)
+	})
+}
+
+// errPartitions is returned for an index with the wrong number of
+// partitions.
+var errPartitions = errors.New("the sealed attempt index has the wrong number of partitions")
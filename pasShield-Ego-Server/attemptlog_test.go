@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCheckpointKeepsFailures checks that a snapshot drops only the buckets
+// without failures once they are full again, for phantom and real keys
+// alike, and that the failures survive a restart.
+func TestCheckpointKeepsFailures(t *testing.T) {
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := parseLockoutSpec("after=5,delay=15m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, counter, database := &softwareSealer{key: key}, &memoryCounter{}, newMemoryStore()
+	limits := bucketLimits{Capacity: 3, Refill: time.Millisecond}
+	_, attempts, err := initialize(database, &sealedState{Sealer: sealer, counter: counter}, limits, lockout, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{"0011", phantomPrefix + "0011", "0022", phantomPrefix + "0022"}
+	for i, saltKey := range keys {
+		if _, err := attempts.take(saltKey); err != nil {
+			t.Fatal(err)
+		}
+		// the second of each pair logs in and is refunded
+		if i >= 2 {
+			if err := attempts.refund(saltKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// every bucket is full again, but the first pair has a failure
+	time.Sleep(10 * limits.Refill)
+	if err := attempts.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	_, restarted, err := initialize(database, &sealedState{Sealer: sealer, counter: counter}, limits, lockout, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, saltKey := range keys {
+		status, err := restarted.status(saltKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if i >= 2 {
+			want = 0
+		}
+		if status.Tokens != limits.Capacity || status.Failures != want {
+			t.Errorf("%s: %d attempts and %d failures after the restart, want %d and %d", saltKey, status.Tokens, status.Failures, limits.Capacity, want)
+		}
+	}
+}
+
+// TestEvictionReload checks that clean partitions beyond the cache are
+// evicted, that an evicted bucket is reloaded from its sealed row with its
+// attempts and failures, and that an older copy of the row is refused.
+func TestEvictionReload(t *testing.T) {
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	lockout, err := parseLockoutSpec("after=5,delay=15m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, counter, database := &softwareSealer{key: key}, &memoryCounter{}, newMemoryStore()
+	limits := bucketLimits{Capacity: 3, Refill: time.Hour}
+	// one clean partition per shard
+	_, attempts, err := initialize(database, &sealedState{Sealer: sealer, counter: counter}, limits, lockout, attemptShards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// three accounts in different partitions of the same shard
+	var saltKeys []string
+	var ids []int
+	shard, _ := attempts.locate("0")
+	for i := 0; len(saltKeys) < 3; i++ {
+		saltKey := fmt.Sprintf("%04x", i)
+		s, id := attempts.locate(saltKey)
+		if s == shard && (len(ids) == 0 || ids[len(ids)-1] != id) {
+			saltKeys, ids = append(saltKeys, saltKey), append(ids, id)
+		}
+	}
+	a, b, c := saltKeys[0], saltKeys[1], saltKeys[2]
+	for _, saltKey := range []string{a, a, b} {
+		if _, err := attempts.take(saltKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// dirty partitions stay in memory until the checkpoint
+	if len(shard.partitions) != 2 {
+		t.Fatalf("%d partitions in memory before the checkpoint, want 2", len(shard.partitions))
+	}
+	if err := attempts.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	old, err := database.GetAttemptPartition(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// using c evicts a and b, and a is reloaded from its row
+	if _, err := attempts.status(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := shard.partitions[ids[0]]; ok || len(shard.partitions) != 1 {
+		t.Fatalf("%d partitions in memory, want only the one used last", len(shard.partitions))
+	}
+	status, err := attempts.status(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Tokens != 1 || status.Failures != 2 {
+		t.Errorf("reloaded bucket has %d attempts and %d failures, want 1 and 2", status.Tokens, status.Failures)
+	}
+
+	// a newer row of a replaces old; after another eviction the host puts
+	// the old row back
+	if _, err := attempts.take(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := attempts.snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attempts.status(c); err != nil {
+		t.Fatal(err)
+	}
+	index, err := database.GetSealedAttempts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.PutAttemptCheckpoint(index, map[int][]byte{ids[0]: old}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := attempts.status(a); err == nil || !strings.Contains(err.Error(), "stale partition") {
+		t.Errorf("an older copy of an evicted partition is not refused (%v)", err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgelesssys/ego/attestation"
+	"github.com/edgelesssys/ego/enclave"
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// localIssuer is the issuer (iss) of tokens created by the local attester
+const localIssuer = "passhield-local-attestation"
+
+// localTokenLifetime is how long a token of the local attester is valid
+const localTokenLifetime = 8 * time.Hour
+
+// Attester creates an attestation token that binds data (the TLS
+// certificate) to the identity of the enclave.
+type Attester interface {
+	Attest(data []byte) (string, error)
+}
+
+// attestationToken is the token served under /token. checkTokenExpiration
+// renews it while the handlers read it.
+type attestationToken struct {
+	mu    sync.RWMutex
+	value string
+}
+
+func (t *attestationToken) get() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.value
+}
+
+func (t *attestationToken) set(value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.value = value
+}
+
+// azureAttester gets the token from a Microsoft Azure Attestation provider.
+type azureAttester struct {
+	providerURL string
+}
+
+func (a azureAttester) Attest(data []byte) (string, error) {
+	return enclave.CreateAzureAttestationToken(data, a.providerURL)
+}
+
+// localClaims are the private claims of an attestation token. They use the
+// same names as the claims of Microsoft Azure Attestation.
+type localClaims struct {
+	Data            string `json:"x-ms-sgx-ehd"`
+	SecurityVersion uint   `json:"x-ms-sgx-svn"`
+	Debug           bool   `json:"x-ms-sgx-is-debuggable"`
+	UniqueID        string `json:"x-ms-sgx-mrenclave"`
+	SignerID        string `json:"x-ms-sgx-mrsigner"`
+	ProductID       uint   `json:"x-ms-sgx-product-id"`
+}
+
+// localAttester is a stand-in for Azure Attestation that signs tokens
+// itself with an RSA key kept in a local file. It does not produce or
+// check an SGX quote and is meant for development and tests without SGX.
+type localAttester struct {
+	key             *rsa.PrivateKey
+	uniqueID        []byte
+	productID       uint
+	securityVersion uint
+	debug           bool
+}
+
+// newLocalAttester loads the signing key from keyFile, creating it if it
+// does not exist yet. The public key is written to keyFile + ".pub" so
+// that clients can be configured to verify the tokens.
+func newLocalAttester(keyFile string, productID uint, securityVersion uint, debug bool) (*localAttester, error) {
+	key, err := loadOrCreateRSAKey(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePublicKey(keyFile+".pub", &key.PublicKey); err != nil {
+		return nil, err
+	}
+	uniqueID, err := executableHash()
+	if err != nil {
+		return nil, err
+	}
+	return &localAttester{key: key, uniqueID: uniqueID, productID: productID, securityVersion: securityVersion, debug: debug}, nil
+}
+
+// signerID stands in for MRSIGNER: the SHA-256 of the signing key's modulus.
+func (a *localAttester) signerID() []byte {
+	hash := sha256.Sum256(a.key.PublicKey.N.Bytes())
+	return hash[:]
+}
+
+func (a *localAttester) Attest(data []byte) (string, error) {
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: a.key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	publicClaims := jwt.Claims{
+		Issuer:    localIssuer,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(localTokenLifetime)),
+	}
+	privateClaims := localClaims{
+		Data:            base64.RawURLEncoding.EncodeToString(data),
+		SecurityVersion: a.securityVersion,
+		Debug:           a.debug,
+		UniqueID:        hex.EncodeToString(a.uniqueID),
+		SignerID:        hex.EncodeToString(a.signerID()),
+		ProductID:       a.productID,
+	}
+	return jwt.Signed(signer).Claims(publicClaims).Claims(privateClaims).CompactSerialize()
+}
+
+// executableHash stands in for MRENCLAVE: the SHA-256 of the running binary.
+func executableHash() ([]byte, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	exe, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(exe)
+	return hash[:], nil
+}
+
+func loadOrCreateRSAKey(keyFile string) (*rsa.PrivateKey, error) {
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, errors.New("no RSA private key found in " + keyFile)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// writePublicKey writes key to file as a PEM "PUBLIC KEY" block.
+func writePublicKey(file string, key *rsa.PublicKey) error {
+	pubBytes, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return err
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubBytes})
+	return ioutil.WriteFile(file, pubPEM, 0644)
+}
+
+// parsePublicKey parses a PEM "PUBLIC KEY" block holding an RSA key.
+func parsePublicKey(pubPEM []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(pubPEM)
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return key, nil
+}
+
+// Verifier checks an attestation token and returns the report it contains.
+// The server needs it for the offline commands and to talk to peer enclaves.
+type Verifier interface {
+	Verify(token string) (attestation.Report, error)
+}
+
+// azureVerifier verifies tokens of a Microsoft Azure Attestation provider.
+type azureVerifier struct {
+	providerURL string
+}
+
+func (v azureVerifier) Verify(token string) (attestation.Report, error) {
+	return attestation.VerifyAzureAttestationToken(token, v.providerURL)
+}
+
+// localVerifier verifies tokens of the local attester with its public key.
+type localVerifier struct {
+	key *rsa.PublicKey
+}
+
+func (v localVerifier) Verify(rawToken string) (attestation.Report, error) {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	var publicClaims jwt.Claims
+	var privateClaims localClaims
+	if err := token.Claims(v.key, &publicClaims, &privateClaims); err != nil {
+		return attestation.Report{}, err
+	}
+	if err := publicClaims.Validate(jwt.Expected{Issuer: localIssuer, Time: time.Now()}); err != nil {
+		return attestation.Report{}, err
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(privateClaims.Data)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	uniqueID, err := hex.DecodeString(privateClaims.UniqueID)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	signerID, err := hex.DecodeString(privateClaims.SignerID)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	productID := make([]byte, 16)
+	binary.LittleEndian.PutUint16(productID, uint16(privateClaims.ProductID))
+	return attestation.Report{
+		Data:            data,
+		SecurityVersion: privateClaims.SecurityVersion,
+		Debug:           privateClaims.Debug,
+		UniqueID:        uniqueID,
+		SignerID:        signerID,
+		ProductID:       productID,
+	}, nil
+}
+
+// newVerifier returns the verifier matching the attester name. pubKeyFile
+// is the attest.key.pub of the local attester.
+func newVerifier(name string, providerURL string, pubKeyFile string) (Verifier, error) {
+	switch name {
+	case "azure":
+		return azureVerifier{providerURL: providerURL}, nil
+	case "local":
+		pubPEM, err := ioutil.ReadFile(pubKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parsePublicKey(pubPEM)
+		if err != nil {
+			return nil, err
+		}
+		return localVerifier{key: key}, nil
+	default:
+		return nil, errors.New("unknown attester: " + name)
+	}
+}
+
+// attestedClient fetches the attestation token from /token of serverURL,
+// checks that it comes from the expected enclave and returns a client that
+// only trusts the TLS certificate bound into the token.
+func attestedClient(verifier Verifier, serverURL string, signer string, uniqueID string) (*http.Client, error) {
+	insecure := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}, Timeout: 10 * time.Second}
+	resp, err := insecure.Get(strings.TrimSuffix(serverURL, "/") + "/token")
+	if err != nil {
+		return nil, err
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	report, err := verifyEnclave(verifier, string(token), signer, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	// pin the exact certificate bound in the token; the enclave's
+	// self-signed certificate expires after an hour, but the token proves
+	// it whatever its dates are
+	cert := report.Data
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], cert) {
+				return errors.New("the server certificate is not the one bound in its attestation token")
+			}
+			return nil
+		},
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// newAttester returns the attester selected by name, "azure" or "local".
+func newAttester(name string, providerURL string, keyFile string) (Attester, error) {
+	switch name {
+	case "azure":
+		return azureAttester{providerURL: providerURL}, nil
+	case "local":
+		// same identity values as in enclave.json
+		return newLocalAttester(keyFile, 1234, 2, true)
+	default:
+		return nil, errors.New("unknown attester: " + name)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestAttestedClientPinsCertificate checks that the client trusts exactly
+// the certificate bound in the token, also after it expired, and nothing
+// else.
+func TestAttestedClientPinsCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	attester, err := newLocalAttester(filepath.Join(dir, "attest.key"), 1234, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ioutil.ReadFile(filepath.Join(dir, "attest.key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Attester = "local"
+	cfg.CounterVerifierKey = string(pub)
+	verifier, err := newCounterVerifier(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := hex.EncodeToString(attester.signerID())
+
+	// an enclave that has been up for longer than its certificate lasts
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: &big.Int{},
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	expired, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := attester.Attest(expired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(cert []byte, key interface{}) *httptest.Server {
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/token" {
+				fmt.Fprint(w, token)
+				return
+			}
+			fmt.Fprint(w, "ok")
+		}))
+		server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}}
+		server.StartTLS()
+		return server
+	}
+
+	enclave := serve(expired, priv)
+	defer enclave.Close()
+	client, err := attestedClient(verifier, enclave.URL, signer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(enclave.URL + "/ping")
+	if err != nil {
+		t.Fatalf("the pinned certificate is refused: %v", err)
+	}
+	resp.Body.Close()
+
+	// a host replaying the token in front of its own certificate
+	otherCert, otherKey := createCertificate()
+	host := serve(otherCert, otherKey)
+	defer host.Close()
+	client, err = attestedClient(verifier, host.URL, signer, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := client.Get(host.URL + "/ping"); err == nil {
+		resp.Body.Close()
+		t.Error("a certificate not bound in the token is accepted")
+	}
+}
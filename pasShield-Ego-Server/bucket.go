@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// errNoAttempts is returned when an account's bucket is empty.
+var errNoAttempts = errors.New("no attempts left")
+
+// errBucketFull tells attemptLog.change that a refund has nothing to do.
+var errBucketFull = errors.New("bucket is full")
+
+// bucket is the token bucket limiting the login attempts of one account.
+// Tokens attempts are left, and the refills up to Refilled are included.
+// It also carries the lockout state: Failures counts the attempts since
+// the last successful login, the account is locked until Until, and
+// Locked is when it was locked for good.
+type bucket struct {
+	Tokens   int        `json:"tokens"`
+	Refilled time.Time  `json:"refilled"`
+	Failures int        `json:"failures,omitempty"`
+	Until    *time.Time `json:"until,omitempty"`
+	Locked   *time.Time `json:"locked,omitempty"`
+}
+
+// bucketLimits are the capacity of every bucket and the time it takes to
+// regain one attempt.
+type bucketLimits struct {
+	Capacity int
+	Refill   time.Duration
+}
+
+// fullBucket is the bucket of a new account.
+func (limits bucketLimits) fullBucket(now time.Time) bucket {
+	return bucket{Tokens: limits.Capacity, Refilled: now}
+}
+
+// bucketKey returns the key of the bucket of a record: its salt, which the
+// mac covers. A missing bucket is a full one, so a key the host could
+// change without breaking the record would give the account fresh
+// attempts.
+func bucketKey(record passwordRecord) string {
+	return fmt.Sprintf("%x", record.Salt)
+}
+
+// full tells whether b is the same as a full bucket, which is not stored.
+func (b bucket) full(limits bucketLimits) bool {
+	return b.Tokens >= limits.Capacity && b.Failures == 0 && b.Until == nil && b.Locked == nil
+}
+
+// refill adds the attempts regained since b.Refilled, up to the capacity.
+// A full bucket starts refilling from now once an attempt is taken.
+// The lockout state is kept.
+func (b bucket) refill(limits bucketLimits, now time.Time) bucket {
+	if now.Before(b.Refilled) && b.Tokens < limits.Capacity {
+		return b
+	}
+	regained := int(now.Sub(b.Refilled) / limits.Refill)
+	if b.Tokens >= limits.Capacity || regained >= limits.Capacity-b.Tokens {
+		b.Tokens, b.Refilled = limits.Capacity, now
+		return b
+	}
+	b.Tokens += regained
+	b.Refilled = b.Refilled.Add(time.Duration(regained) * limits.Refill)
+	return b
+}
+
+// bucketStatus is the answer of the admin bucket query.
+type bucketStatus struct {
+	Username string     `json:"username"`
+	Tokens   int        `json:"tokens"`
+	Capacity int        `json:"capacity"`
+	Refill   string     `json:"refillInterval"`
+	Next     *time.Time `json:"nextAttempt,omitempty"`
+	Full     *time.Time `json:"full,omitempty"`
+	Failures int        `json:"failures,omitempty"`
+	Until    *time.Time `json:"lockedUntil,omitempty"`
+	Locked   *time.Time `json:"hardLocked,omitempty"`
+}
+
+// status describes b after refilling; Next and Full are unset for a full
+// bucket, Until once the lock expired.
+func (b bucket) status(limits bucketLimits, now time.Time) bucketStatus {
+	b = b.refill(limits, now)
+	status := bucketStatus{Tokens: b.Tokens, Capacity: limits.Capacity, Refill: limits.Refill.String()}
+	if b.Tokens < limits.Capacity {
+		next := b.Refilled.Add(limits.Refill)
+		full := b.Refilled.Add(time.Duration(limits.Capacity-b.Tokens) * limits.Refill)
+		status.Next, status.Full = &next, &full
+	}
+	status.Failures, status.Locked = b.Failures, b.Locked
+	if b.Until != nil && b.Until.After(now) {
+		status.Until = b.Until
+	}
+	return status
+}
+
+// bucketHandler shows support staff the bucket of the account given by
+// the username query parameter, e.g. why a user is throttled.
+func bucketHandler(database UserStore, attempts *attemptLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username := r.URL.Query().Get("username")
+		saltKey, found := lookupSaltKey(w, database, username)
+		if !found {
+			return
+		}
+		status, err := attempts.status(saltKey)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to read the bucket", http.StatusInternalServerError)
+			return
+		}
+		status.Username = username
+		writeJSON(w, status)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the server. Values are taken from the
+// defaults, then the measured JSON config file, then PASSHIELD_*
+// environment variables, then the host config file and finally the command
+// line flags, each overriding the last. The host config file and the flags
+// may only set the operational settings.
+type Config struct {
+	ServerAddr             string   `json:"serverAddr"`
+	SaltSize               int      `json:"saltSize"`
+	MaxAttempts            int      `json:"maxAttempts"`
+	AttestationProviderURL string   `json:"attestationProviderURL"`
+	Sealer                 string   `json:"sealer"`
+	SealKeyFile            string   `json:"sealKeyFile"`
+	Attester               string   `json:"attester"`
+	AttestKeyFile          string   `json:"attestKeyFile"`
+	Store                  string   `json:"store"`
+	DatabaseDSN            string   `json:"database"`
+	RefillInterval         Duration `json:"refillInterval"`
+	Lockout                string   `json:"lockout"`
+	AttemptCache           int      `json:"attemptCache"`
+	TokenCheckInterval     Duration `json:"tokenCheckInterval"`
+	SessionTTL             Duration `json:"sessionTTL"`
+	SessionIdleTimeout     Duration `json:"sessionIdleTimeout"`
+	SessionSweepInterval   Duration `json:"sessionSweepInterval"`
+	AdminTokenHash         string   `json:"adminTokenHash"`
+	PreHash                string   `json:"preHash"`
+	MAC                    string   `json:"mac"`
+	Normalization          string   `json:"normalization"`
+	KeyImport              bool     `json:"keyImport"`
+	KeyImportFingerprint   string   `json:"keyImportFingerprint"`
+	Counter                string   `json:"counter"`
+	CounterFile            string   `json:"counterFile"`
+	CounterPeers           []string `json:"counterPeers"`
+	CounterQuorum          int      `json:"counterQuorum"`
+	CounterID              string   `json:"counterID"`
+	CounterSigner          string   `json:"counterSigner"`
+	CounterVerifierKey     string   `json:"counterVerifierKey"`
+	CounterPeerFile        string   `json:"counterPeerFile"`
+	ClientLimit            string   `json:"clientLimit"`
+	SubnetLimit            string   `json:"subnetLimit"`
+	GlobalLimit            string   `json:"globalLimit"`
+	TrustedProxies         []string `json:"trustedProxies"`
+	// Custodians has no flag, it is only read from the config files
+	Custodians         []custodianKey `json:"custodians"`
+	CustodianThreshold int            `json:"custodianThreshold"`
+	// AdminToken is only read to refuse it: the measured config is
+	// readable by the host, so it holds the hash of the token instead
+	AdminToken string `json:"adminToken"`
+}
+
+// Duration is a time.Duration written as a string such as "24h" in the
+// config file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// stringList is a list flag written as comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func defaultConfig() Config {
+	return Config{
+		ServerAddr:             "0.0.0.0:8080",
+		SaltSize:               16,
+		MaxAttempts:            3,
+		AttestationProviderURL: "https://shareduks.uks.attest.azure.net",
+		Sealer:                 "ego",
+		SealKeyFile:            "./data/seal.key",
+		Attester:               "azure",
+		AttestKeyFile:          "./data/attest.key",
+		Store:                  "sqlite",
+		DatabaseDSN:            "./data/password.db",
+		RefillInterval:         Duration{8 * time.Hour},
+		Lockout:                "after=3,delay=15m,max-delay=24h,hard=10",
+		AttemptCache:           4096,
+		TokenCheckInterval:     Duration{8 * time.Hour},
+		SessionTTL:             Duration{24 * time.Hour},
+		SessionIdleTimeout:     Duration{30 * time.Minute},
+		SessionSweepInterval:   Duration{10 * time.Minute},
+		MAC:                    algHmacSHA256,
+		Normalization:          "none",
+		Counter:                "file",
+		CounterFile:            "./data/state.counter",
+		CounterID:              "passhield",
+		CounterPeerFile:        "./data/peer.counters",
+		ClientLimit:            "reject,capacity=20,refill=1m,v4=32,v6=64,status=429",
+		SubnetLimit:            "reject,capacity=200,refill=6s,v4=24,v6=48,status=429",
+		GlobalLimit:            "delay,capacity=100,refill=10ms,max-delay=2s,status=503",
+	}
+}
+
+// newFlagSet binds one flag to every field of cfg. The current values of
+// cfg become the flag defaults.
+func newFlagSet(cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	fs.String("host-config", "", "JSON config file of the operational settings, chosen by the host (env PASSHIELD_HOST_CONFIG)")
+	fs.StringVar(&cfg.ServerAddr, "addr", cfg.ServerAddr, "address the HTTPS server listens on")
+	fs.IntVar(&cfg.SaltSize, "salt-size", cfg.SaltSize, "size of the per-user salt in bytes")
+	fs.IntVar(&cfg.MaxAttempts, "max-attempts", cfg.MaxAttempts, "capacity of the token bucket limiting the login attempts of an account")
+	fs.StringVar(&cfg.AttestationProviderURL, "attestation-provider", cfg.AttestationProviderURL, "URL of the Azure attestation provider")
+	fs.StringVar(&cfg.Sealer, "sealer", cfg.Sealer, "sealing backend: ego or software")
+	fs.StringVar(&cfg.SealKeyFile, "seal-key", cfg.SealKeyFile, "key file for the software sealer")
+	fs.StringVar(&cfg.Attester, "attester", cfg.Attester, "attestation provider: azure or local")
+	fs.StringVar(&cfg.AttestKeyFile, "attest-key", cfg.AttestKeyFile, "signing key file for the local attester")
+	fs.StringVar(&cfg.Store, "store", cfg.Store, "database backend: sqlite, postgres or memory")
+	fs.StringVar(&cfg.DatabaseDSN, "db", cfg.DatabaseDSN, "sqlite database file or postgres connection string")
+	fs.DurationVar(&cfg.RefillInterval.Duration, "refill-interval", cfg.RefillInterval.Duration, "time in which an account regains one login attempt")
+	fs.StringVar(&cfg.Lockout, "lockout", cfg.Lockout, "lockout after failed logins, e.g. after=3,delay=15m,max-delay=24h,hard=10, or none")
+	fs.IntVar(&cfg.AttemptCache, "attempt-cache", cfg.AttemptCache, "attempt partitions without unsealed changes kept in memory")
+	fs.DurationVar(&cfg.TokenCheckInterval.Duration, "token-check-interval", cfg.TokenCheckInterval.Duration, "how often the attestation token is checked for expiry")
+	fs.DurationVar(&cfg.SessionTTL.Duration, "session-ttl", cfg.SessionTTL.Duration, "how long a login session lasts at most")
+	fs.DurationVar(&cfg.SessionIdleTimeout.Duration, "session-idle-timeout", cfg.SessionIdleTimeout.Duration, "how long a login session may go unused, 0 for no limit")
+	fs.DurationVar(&cfg.SessionSweepInterval.Duration, "session-sweep-interval", cfg.SessionSweepInterval.Duration, "how often expired sessions are deleted")
+	fs.StringVar(&cfg.PreHash, "pre-hash", cfg.PreHash, "memory-hard pre-hash for new records, e.g. argon2id,t=3,m=65536,p=1 or scrypt,n=32768,r=8,p=1 (default none)")
+	fs.StringVar(&cfg.MAC, "mac", cfg.MAC, "MAC algorithm for new records: "+strings.Join(macAlgorithmNames(), ", "))
+	fs.StringVar(&cfg.Normalization, "normalization", cfg.Normalization, "Unicode normalization of passwords in new records: "+strings.Join(normalizationNames(), ", "))
+	fs.BoolVar(&cfg.KeyImport, "key-import", cfg.KeyImport, "restore the hmac key from custodian shares before starting")
+	fs.StringVar(&cfg.KeyImportFingerprint, "key-import-fingerprint", cfg.KeyImportFingerprint, "fingerprint of the exported key ring a key import must restore, hex")
+	fs.StringVar(&cfg.Counter, "counter", cfg.Counter, "rollback counter for the sealed state: file or peers")
+	fs.StringVar(&cfg.CounterFile, "counter-file", cfg.CounterFile, "file of the file counter")
+	fs.Var((*stringList)(&cfg.CounterPeers), "counter-peers", "comma separated URLs of the pasShield enclaves keeping the counter")
+	fs.IntVar(&cfg.CounterQuorum, "counter-quorum", cfg.CounterQuorum, "counter peers that must answer (default a majority)")
+	fs.StringVar(&cfg.CounterID, "counter-id", cfg.CounterID, "name of this server's counter at the peers")
+	fs.StringVar(&cfg.CounterSigner, "counter-signer", cfg.CounterSigner, "expected signer id (MRSIGNER) of the counter peers, hex")
+	fs.StringVar(&cfg.CounterVerifierKey, "counter-verifier-key", cfg.CounterVerifierKey, "PEM public key of the local attester of the counter peers")
+	fs.StringVar(&cfg.CounterPeerFile, "counter-peer-file", cfg.CounterPeerFile, "sealed file of the counters kept for peers")
+	fs.StringVar(&cfg.ClientLimit, "client-limit", cfg.ClientLimit, "login guesses per client address, or none")
+	fs.StringVar(&cfg.SubnetLimit, "subnet-limit", cfg.SubnetLimit, "login guesses per client subnet, or none")
+	fs.StringVar(&cfg.GlobalLimit, "global-limit", cfg.GlobalLimit, "login guesses of all clients together, or none")
+	fs.Var((*stringList)(&cfg.TrustedProxies), "trusted-proxies", "comma separated addresses or CIDRs of proxies whose X-Forwarded-For is trusted")
+	fs.IntVar(&cfg.CustodianThreshold, "custodian-threshold", cfg.CustodianThreshold, "custodians needed to restore a key ring export")
+	fs.StringVar(&cfg.AdminTokenHash, "admin-token-hash", cfg.AdminTokenHash, "SHA-256 of the bearer token for the /admin endpoints, hex; they are disabled if empty")
+	return fs
+}
+
+// envName maps a flag name to its environment variable, e.g. "max-attempts"
+// to PASSHIELD_MAX_ATTEMPTS.
+func envName(flagName string) string {
+	return "PASSHIELD_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// operational maps the flag names of the settings the host may choose to
+// their JSON names. Inside the enclave only the environment is measured:
+// enclave.json fixes it at signing time, together with the files it embeds.
+// The file named by PASSHIELD_CONFIG (an embedded one) and the PASSHIELD_*
+// variables may set everything; the host config file and the command line
+// flags, which come from the host, only these.
+var operational = map[string]string{
+	"addr":                   "serverAddr",
+	"store":                  "store",
+	"db":                     "database",
+	"attempt-cache":          "attemptCache",
+	"token-check-interval":   "tokenCheckInterval",
+	"session-sweep-interval": "sessionSweepInterval",
+	"counter-file":           "counterFile",
+	"counter-peers":          "counterPeers",
+	"counter-peer-file":      "counterPeerFile",
+	"key-import":             "keyImport",
+}
+
+// loadConfig builds the config from the defaults, the measured config file,
+// the environment, the host config file and args, and validates it.
+func loadConfig(args []string) (Config, error) {
+	// find the host config file first and refuse flags the host may not
+	// set; fs.Parse below reports malformed flags
+	scratch := defaultConfig()
+	pre := newFlagSet(&scratch)
+	pre.SetOutput(ioutil.Discard)
+	pre.Usage = func() {}
+	pre.Parse(args)
+	var flagErr error
+	pre.Visit(func(f *flag.Flag) {
+		if _, ok := operational[f.Name]; !ok && f.Name != "host-config" && flagErr == nil {
+			flagErr = fmt.Errorf("-%s can only be set in the measured config", f.Name)
+		}
+	})
+	if flagErr != nil {
+		return Config{}, flagErr
+	}
+	hostFile := os.Getenv(envName("host-config"))
+	if f := pre.Lookup("host-config"); f.Value.String() != "" {
+		hostFile = f.Value.String()
+	}
+
+	cfg := defaultConfig()
+	if err := readConfigFile(os.Getenv(envName("config")), &cfg, false); err != nil {
+		return Config{}, err
+	}
+
+	fs := newFlagSet(&cfg)
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value, ok := os.LookupEnv(envName(f.Name)); ok && envErr == nil {
+			if err := fs.Set(f.Name, value); err != nil {
+				envErr = fmt.Errorf("%s: %v", envName(f.Name), err)
+			}
+		}
+	})
+	if envErr != nil {
+		return Config{}, envErr
+	}
+	if _, ok := os.LookupEnv(envName("admin-token")); ok {
+		return Config{}, fmt.Errorf("%s is not supported, set %s to the SHA-256 of the token", envName("admin-token"), envName("admin-token-hash"))
+	}
+	if err := readConfigFile(hostFile, &cfg, true); err != nil {
+		return Config{}, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// readConfigFile applies the JSON config file to cfg, if file is set. A
+// host file may only hold operational settings.
+func readConfigFile(file string, cfg *Config, host bool) error {
+	if file == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if host {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fmt.Errorf("config file %s: %v", file, err)
+		}
+		allowed := make(map[string]bool)
+		for _, name := range operational {
+			allowed[name] = true
+		}
+		for name := range fields {
+			if !allowed[name] {
+				return fmt.Errorf("config file %s: %s can only be set in the measured config", file, name)
+			}
+		}
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("config file %s: %v", file, err)
+	}
+	return nil
+}
+
+// Validate checks that the config is usable before the server starts.
+func (c Config) Validate() error {
+	if c.ServerAddr == "" {
+		return errors.New("serverAddr must be set")
+	}
+	if c.SaltSize < 16 {
+		return errors.New("saltSize must be at least 16 bytes")
+	}
+	if c.MaxAttempts < 1 {
+		return errors.New("maxAttempts must be at least 1")
+	}
+	if c.RefillInterval.Duration <= 0 {
+		return errors.New("refillInterval must be positive")
+	}
+	if c.AttemptCache < 1 {
+		return errors.New("attemptCache must be at least 1")
+	}
+	if c.TokenCheckInterval.Duration <= 0 {
+		return errors.New("tokenCheckInterval must be positive")
+	}
+	if c.SessionTTL.Duration <= 0 {
+		return errors.New("sessionTTL must be positive")
+	}
+	if c.SessionIdleTimeout.Duration < 0 {
+		return errors.New("sessionIdleTimeout must not be negative")
+	}
+	if c.SessionSweepInterval.Duration <= 0 {
+		return errors.New("sessionSweepInterval must be positive")
+	}
+	switch c.Sealer {
+	case "ego":
+	case "software":
+		if c.SealKeyFile == "" {
+			return errors.New("sealKeyFile must be set for the software sealer")
+		}
+	default:
+		return errors.New("unknown sealer: " + c.Sealer)
+	}
+	switch c.Attester {
+	case "azure":
+		uri, err := url.Parse(c.AttestationProviderURL)
+		if err != nil || uri.Scheme != "https" {
+			return errors.New("attestationProviderURL must be an https URL")
+		}
+	case "local":
+		if c.AttestKeyFile == "" {
+			return errors.New("attestKeyFile must be set for the local attester")
+		}
+	default:
+		return errors.New("unknown attester: " + c.Attester)
+	}
+	if _, err := parsePreHash(c.PreHash); err != nil {
+		return err
+	}
+	if _, ok := macAlgorithms[c.MAC]; !ok {
+		return errors.New("unknown mac algorithm: " + c.MAC)
+	}
+	if _, ok := normalizations[c.Normalization]; !ok {
+		return errors.New("unknown normalization: " + c.Normalization)
+	}
+	if _, err := parseCustodians(c.Custodians, c.CustodianThreshold); err != nil {
+		return err
+	}
+	if c.AdminToken != "" {
+		return errors.New("adminToken is not supported, set adminTokenHash to the SHA-256 of the token")
+	}
+	if c.AdminTokenHash != "" {
+		if hash, err := hex.DecodeString(c.AdminTokenHash); err != nil || len(hash) != sha256.Size {
+			return errors.New("adminTokenHash must be a SHA-256 in hex")
+		}
+	}
+	if c.KeyImport && c.AdminTokenHash == "" {
+		return errors.New("keyImport needs an adminTokenHash")
+	}
+	if c.KeyImport && (len(c.Custodians) == 0 || len(c.KeyImportFingerprint) != 64) {
+		return errors.New("keyImport needs the custodians and the keyImportFingerprint of the export")
+	}
+	switch c.Counter {
+	case "file":
+		if c.CounterFile == "" {
+			return errors.New("counterFile must be set for the file counter")
+		}
+	case "peers":
+		if len(c.CounterPeers) == 0 || c.CounterSigner == "" || c.CounterID == "" {
+			return errors.New("counterPeers, counterSigner and counterID must be set for the peers counter")
+		}
+		// a read quorum must overlap every write quorum
+		if c.CounterQuorum != 0 && (c.CounterQuorum*2 <= len(c.CounterPeers) || c.CounterQuorum > len(c.CounterPeers)) {
+			return errors.New("counterQuorum must be more than half of counterPeers")
+		}
+	default:
+		return errors.New("unknown counter: " + c.Counter)
+	}
+	if c.CounterSigner != "" {
+		if _, err := newCounterVerifier(c); err != nil {
+			return err
+		}
+	}
+	if c.CounterPeerFile == "" {
+		return errors.New("counterPeerFile must be set")
+	}
+	if _, err := parseLockoutSpec(c.Lockout); err != nil {
+		return fmt.Errorf("lockout: %v", err)
+	}
+	for name, spec := range map[string]string{"clientLimit": c.ClientLimit, "subnetLimit": c.SubnetLimit, "globalLimit": c.GlobalLimit} {
+		if _, err := parseLimiterSpec(spec); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	switch c.Store {
+	case "sqlite", "postgres":
+		if c.DatabaseDSN == "" {
+			return errors.New("database must be set for the " + c.Store + " store")
+		}
+	case "memory":
+	default:
+		return errors.New("unknown store: " + c.Store)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// peerTimeout bounds every request to a counter peer
+const peerTimeout = 10 * time.Second
+
+// Counter is a monotonic counter the host cannot roll back. The sealed
+// state carries a version that must match it, so the host cannot replay
+// an older copy of the state.
+type Counter interface {
+	// Read returns the current value, 0 for a counter never incremented.
+	Read() (uint64, error)
+	// Advance raises the value to value unless it is already higher, and
+	// returns the new value. One call can thus count several changes.
+	Advance(value uint64) (uint64, error)
+}
+
+// fileCounter keeps the value in a local file. The host controls the file,
+// so it gives no rollback protection and is meant for development and CI
+// machines, like the software sealer.
+type fileCounter struct {
+	mu   sync.Mutex
+	file string
+}
+
+func (c *fileCounter) Read() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read()
+}
+
+func (c *fileCounter) read() (uint64, error) {
+	data, err := ioutil.ReadFile(c.file)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func (c *fileCounter) Advance(value uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	old, err := c.read()
+	if err != nil {
+		return 0, err
+	}
+	if old >= value {
+		return old, nil
+	}
+	return value, writeFileAtomic(c.file, []byte(strconv.FormatUint(value, 10)))
+}
+
+// writeFileAtomic writes a new file and renames it over file, so a crash
+// leaves the old or the new content.
+func writeFileAtomic(file string, data []byte) error {
+	tmp := file + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// counterValue is the body of the /counter requests and responses.
+type counterValue struct {
+	ID    string `json:"id"`
+	Value uint64 `json:"value"`
+}
+
+// peerCounter keeps the value at other pasShield enclaves, checked by
+// attestation. An increment must reach a write quorum and a read asks a
+// read quorum and takes the highest value, so with quorum > n/2 every read
+// sees the last increment. The host can stop but not roll back the counter
+// as long as fewer than quorum peers lose their sealed counters at the
+// same time. The peers check this enclave in turn: it presents its
+// certificate as TLS client certificate and the token binding it.
+type peerCounter struct {
+	mu          sync.Mutex
+	id          string
+	peers       []string
+	quorum      int
+	verifier    Verifier
+	signer      string
+	certificate tls.Certificate
+	token       *attestationToken
+	clients     map[string]*http.Client
+	value       uint64
+}
+
+func (c *peerCounter) Read() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var highest uint64
+	answers := 0
+	for _, peer := range c.peers {
+		var value counterValue
+		if err := c.call(peer, "GET", nil, &value); err != nil {
+			fmt.Printf("counter peer %s: %v\n", peer, err)
+			continue
+		}
+		answers++
+		if value.Value > highest {
+			highest = value.Value
+		}
+	}
+	if answers < c.quorum {
+		return 0, fmt.Errorf("only %d of %d counter peers answered, %d needed", answers, len(c.peers), c.quorum)
+	}
+	c.value = highest
+	return highest, nil
+}
+
+func (c *peerCounter) Advance(value uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if value <= c.value {
+		return c.value, nil
+	}
+	next := counterValue{ID: c.id, Value: value}
+	acks := 0
+	for _, peer := range c.peers {
+		var stored counterValue
+		if err := c.call(peer, "POST", &next, &stored); err != nil {
+			fmt.Printf("counter peer %s: %v\n", peer, err)
+			continue
+		}
+		if stored.Value != next.Value {
+			return 0, fmt.Errorf("counter peer %s is at %d, expected %d", peer, stored.Value, next.Value)
+		}
+		acks++
+	}
+	if acks < c.quorum {
+		return 0, fmt.Errorf("only %d of %d counter peers stored the increment, %d needed", acks, len(c.peers), c.quorum)
+	}
+	c.value = next.Value
+	return next.Value, nil
+}
+
+// call sends one request to the /counter endpoint of an attested peer.
+func (c *peerCounter) call(peer string, method string, body *counterValue, out *counterValue) error {
+	client, ok := c.clients[peer]
+	if !ok {
+		var err error
+		if client, err = attestedClient(c.verifier, peer, c.signer, ""); err != nil {
+			return err
+		}
+		client.Transport.(*http.Transport).TLSClientConfig.Certificates = []tls.Certificate{c.certificate}
+		client.Timeout = peerTimeout
+		c.clients[peer] = client
+	}
+	endpoint := strings.TrimSuffix(peer, "/") + "/counter?id=" + url.QueryEscape(c.id)
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token.get())
+	resp, err := client.Do(req)
+	if err != nil {
+		// the peer may have restarted with a new certificate
+		delete(c.clients, peer)
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// counterPeer serves the counters of other enclaves. Only enclaves of the
+// counter signer may read or raise them: the TLS client certificate must be
+// the one bound into the attestation token sent as bearer token. Values
+// only ever go up and are sealed to file before they are acknowledged.
+type counterPeer struct {
+	mu       sync.Mutex
+	values   map[string]uint64
+	file     string
+	sealer   Sealer
+	verifier Verifier
+	signer   string
+	// verified maps the tokens checked so far to the certificate they bind
+	verified map[string][]byte
+}
+
+// maxVerifiedTokens bounds the tokens a counterPeer remembers
+const maxVerifiedTokens = 256
+
+// newCounterPeer loads the sealed counters of cfg.CounterPeerFile. Without
+// a counter signer the peer serves no counters.
+func newCounterPeer(cfg Config, sealer Sealer) (*counterPeer, error) {
+	p := &counterPeer{values: make(map[string]uint64), file: cfg.CounterPeerFile, sealer: sealer, signer: cfg.CounterSigner, verified: make(map[string][]byte)}
+	if p.signer == "" {
+		return p, nil
+	}
+	var err error
+	if p.verifier, err = newCounterVerifier(cfg); err != nil {
+		return nil, err
+	}
+	sealed, err := ioutil.ReadFile(p.file)
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := sealer.Unseal(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("counters of the peers: %v", err)
+	}
+	if err := json.Unmarshal(data, &p.values); err != nil {
+		return nil, fmt.Errorf("counters of the peers: %v", err)
+	}
+	return p, nil
+}
+
+// authorize checks that the request comes from an enclave of the counter
+// signer, and writes the error response otherwise.
+func (p *counterPeer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if p.verifier == nil {
+		http.Error(w, "This server keeps no counters for peers", http.StatusNotFound)
+		return false
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		http.Error(w, "Counter peers must present their enclave certificate", http.StatusUnauthorized)
+		return false
+	}
+	token := bearerToken(r)
+	p.mu.Lock()
+	cert, ok := p.verified[token]
+	p.mu.Unlock()
+	if !ok {
+		report, err := verifyEnclave(p.verifier, token, p.signer, "")
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Invalid attestation token", http.StatusForbidden)
+			return false
+		}
+		cert = report.Data
+		p.mu.Lock()
+		if len(p.verified) >= maxVerifiedTokens {
+			p.verified = make(map[string][]byte)
+		}
+		p.verified[token] = cert
+		p.mu.Unlock()
+	}
+	// the TLS handshake proved the key of the certificate
+	if !bytes.Equal(cert, r.TLS.PeerCertificates[0].Raw) {
+		http.Error(w, "The attestation token does not bind the client certificate", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (p *counterPeer) handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Only GET and POST requests are allowed", http.StatusBadRequest)
+		return
+	}
+	if !p.authorize(w, r) {
+		return
+	}
+	if r.Method == "GET" {
+		id := r.URL.Query().Get("id")
+		p.mu.Lock()
+		value := p.values[id]
+		p.mu.Unlock()
+		writeJSON(w, counterValue{ID: id, Value: value})
+		return
+	}
+	var update counterValue
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil || update.ID == "" {
+		http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if old := p.values[update.ID]; update.Value > old {
+		p.values[update.ID] = update.Value
+		if err := p.save(); err != nil {
+			p.values[update.ID] = old
+			fmt.Println(err)
+			http.Error(w, "Failed to store the counter", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, counterValue{ID: update.ID, Value: p.values[update.ID]})
+}
+
+// save seals the counters to file; the caller holds p.mu.
+func (p *counterPeer) save() error {
+	data, err := json.Marshal(p.values)
+	if err != nil {
+		return err
+	}
+	sealed, err := p.sealer.Seal(data)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.file, sealed)
+}
+
+// newCounterVerifier returns the verifier of the counter peers' tokens.
+// The local attester's key is pinned in the measured config, as the key
+// file next to attestKeyFile is written by the host.
+func newCounterVerifier(cfg Config) (Verifier, error) {
+	if cfg.Attester != "local" {
+		return newVerifier(cfg.Attester, cfg.AttestationProviderURL, "")
+	}
+	if cfg.CounterVerifierKey == "" {
+		return nil, errors.New("counterVerifierKey must be set for counter peers with the local attester")
+	}
+	key, err := parsePublicKey([]byte(cfg.CounterVerifierKey))
+	if err != nil {
+		return nil, fmt.Errorf("counterVerifierKey: %v", err)
+	}
+	return localVerifier{key: key}, nil
+}
+
+// newCounter returns the counter selected by cfg.Counter, "file" or "peers".
+// The peers counter presents certificate and token to the peers.
+func newCounter(cfg Config, certificate tls.Certificate, token *attestationToken) (Counter, error) {
+	switch cfg.Counter {
+	case "file":
+		return &fileCounter{file: cfg.CounterFile}, nil
+	case "peers":
+		verifier, err := newCounterVerifier(cfg)
+		if err != nil {
+			return nil, err
+		}
+		quorum := cfg.CounterQuorum
+		if quorum == 0 {
+			quorum = len(cfg.CounterPeers)/2 + 1
+		}
+		return &peerCounter{
+			id:          cfg.CounterID,
+			peers:       cfg.CounterPeers,
+			quorum:      quorum,
+			verifier:    verifier,
+			signer:      cfg.CounterSigner,
+			certificate: certificate,
+			token:       token,
+			clients:     make(map[string]*http.Client),
+		}, nil
+	default:
+		return nil, errors.New("unknown counter: " + cfg.Counter)
+	}
+}
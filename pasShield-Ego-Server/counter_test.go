@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestCounterPeer checks that /counter only answers the enclave whose
+// token binds its client certificate and that the counters survive a
+// restart of the peer.
+func TestCounterPeer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	attester, err := newLocalAttester(filepath.Join(dir, "attest.key"), 1234, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ioutil.ReadFile(filepath.Join(dir, "attest.key.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	sealer := &softwareSealer{key: key}
+	cfg := defaultConfig()
+	cfg.Attester = "local"
+	cfg.CounterSigner = hex.EncodeToString(attester.signerID())
+	cfg.CounterVerifierKey = string(pub)
+	cfg.CounterPeerFile = filepath.Join(dir, "peer.counters")
+
+	enclaveCert, _ := createCertificate()
+	otherCert, _ := createCertificate()
+	token, err := attester.Attest(enclaveCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(p *counterPeer, cert []byte, body string) int {
+		r := httptest.NewRequest("POST", "/counter?id=b", strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer "+token)
+		if cert != nil {
+			parsed, err := x509.ParseCertificate(cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{parsed}}
+		}
+		w := httptest.NewRecorder()
+		p.handler(w, r)
+		return w.Code
+	}
+
+	peer, err := newCounterPeer(cfg, sealer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := post(peer, nil, `{"id":"b","value":99}`); code != http.StatusUnauthorized {
+		t.Errorf("without a client certificate: %d", code)
+	}
+	if code := post(peer, otherCert, `{"id":"b","value":99}`); code != http.StatusForbidden {
+		t.Errorf("with a certificate the token does not bind: %d", code)
+	}
+	if code := post(peer, enclaveCert, `{"id":"b","value":5}`); code != http.StatusOK {
+		t.Fatalf("with the enclave certificate: %d", code)
+	}
+
+	restarted, err := newCounterPeer(cfg, sealer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := restarted.values["b"]; value != 5 {
+		t.Errorf("counter is %d after the restart, want 5", value)
+	}
+}
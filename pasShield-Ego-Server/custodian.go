@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/edgelesssys/ego/attestation"
+)
+
+// runCustodian implements the offline side of the key backup for the
+// custodians. It runs outside the enclave on the custodian's machine:
+//
+//	server custodian keygen -key alice.key
+//	server custodian reseal -key alice.key -name alice -bundle export.json -import import.json -out alice.share.json
+func runCustodian(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: server custodian keygen|reseal [flags]")
+	}
+	switch args[0] {
+	case "keygen":
+		return custodianKeygen(args[1:])
+	case "reseal":
+		return custodianReseal(args[1:])
+	default:
+		return errors.New("unknown custodian command: " + args[0])
+	}
+}
+
+// custodianKeygen creates the custodian's key pair. The public key in
+// keyFile + ".pub" goes into the export request.
+func custodianKeygen(args []string) error {
+	fs := flag.NewFlagSet("custodian keygen", flag.ContinueOnError)
+	keyFile := fs.String("key", "custodian.key", "private key file to create")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := os.Stat(*keyFile); err == nil {
+		return errors.New(*keyFile + " already exists")
+	}
+	key, err := loadOrCreateRSAKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	if err := writePublicKey(*keyFile+".pub", &key.PublicKey); err != nil {
+		return err
+	}
+	fmt.Printf("🔑 Wrote %s and %s.pub\n", *keyFile, *keyFile)
+	return nil
+}
+
+// custodianReseal checks the attestation of the export bundle and of the
+// importing enclave, decrypts the custodian's share and encrypts it to the
+// import key, signed with the custodian's key. The output can be posted to
+// /admin/keys/import by anyone.
+func custodianReseal(args []string) error {
+	fs := flag.NewFlagSet("custodian reseal", flag.ContinueOnError)
+	keyFile := fs.String("key", "custodian.key", "custodian private key file")
+	name := fs.String("name", "", "custodian name used in the export request")
+	bundleFile := fs.String("bundle", "export.json", "export bundle from /admin/keys/export")
+	importFile := fs.String("import", "import.json", "import key from GET /admin/keys/import")
+	outFile := fs.String("out", "share.json", "file to write the re-encrypted share to")
+	attesterName := fs.String("attester", "azure", "attester of the enclaves: azure or local")
+	providerURL := fs.String("attestation-provider", defaultConfig().AttestationProviderURL, "URL of the Azure attestation provider")
+	attestPub := fs.String("attest-pub", "attest.key.pub", "public key of the local attester")
+	signer := fs.String("signer", "", "expected signer id (MRSIGNER) of both enclaves, hex")
+	uniqueID := fs.String("unique-id", "", "expected unique id (MRENCLAVE) of the importing enclave, hex (optional)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *name == "" || *signer == "" {
+		return errors.New("-name and -signer must be set")
+	}
+	verifier, err := newVerifier(*attesterName, *providerURL, *attestPub)
+	if err != nil {
+		return err
+	}
+
+	var bundle exportBundle
+	if err := readJSON(*bundleFile, &bundle); err != nil {
+		return err
+	}
+	hash := sha256.Sum256(bundle.Export)
+	if err := checkReport(verifier, bundle.Token, hash[:], *signer, ""); err != nil {
+		return fmt.Errorf("export bundle: %v", err)
+	}
+	var export keyExport
+	if err := json.Unmarshal(bundle.Export, &export); err != nil {
+		return err
+	}
+
+	var target importKey
+	if err := readJSON(*importFile, &target); err != nil {
+		return err
+	}
+	importPub, err := parsePublicKey([]byte(target.PublicKey))
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(importPub)
+	if err != nil {
+		return err
+	}
+	hash = sha256.Sum256(der)
+	if err := checkReport(verifier, target.Token, hash[:], *signer, *uniqueID); err != nil {
+		return fmt.Errorf("import key: %v", err)
+	}
+
+	key, err := loadOrCreateRSAKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	for _, s := range export.Shares {
+		if s.Custodian != *name {
+			continue
+		}
+		share, err := decryptShare(key, shareLabel, s)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt the share of %s: %v", *name, err)
+		}
+		resealed, err := encryptShare(importPub, importLabel, *name, share)
+		if err != nil {
+			return err
+		}
+		signed := importShare{Fingerprint: export.Fingerprint, Share: resealed}
+		if err := signed.sign(key, der); err != nil {
+			return err
+		}
+		out, err := json.Marshal(signed)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*outFile, out, 0644); err != nil {
+			return err
+		}
+		fmt.Printf("🔑 Wrote the share of %s for key ring %s to %s\n", *name, export.Fingerprint, *outFile)
+		return nil
+	}
+	return errors.New("the bundle has no share for " + *name)
+}
+
+// checkReport verifies an attestation token and that it binds data and
+// comes from the expected enclave.
+func checkReport(verifier Verifier, token string, data []byte, signer string, uniqueID string) error {
+	report, err := verifyEnclave(verifier, token, signer, uniqueID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(report.Data, data) {
+		return errors.New("token does not attest this data")
+	}
+	return nil
+}
+
+// verifyEnclave verifies an attestation token and that it comes from the
+// expected enclave. An empty uniqueID accepts any enclave of the signer.
+func verifyEnclave(verifier Verifier, token string, signer string, uniqueID string) (attestation.Report, error) {
+	report, err := verifier.Verify(token)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	if hex.EncodeToString(report.SignerID) != signer {
+		return attestation.Report{}, errors.New("token does not contain the right signer id")
+	}
+	if uniqueID != "" && hex.EncodeToString(report.UniqueID) != uniqueID {
+		return attestation.Report{}, errors.New("token does not contain the right unique id")
+	}
+	if report.Debug {
+		fmt.Println("⚠️ The enclave runs in debug mode, its memory is not protected.")
+	}
+	return report, nil
+}
+
+func readJSON(file string, v interface{}) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
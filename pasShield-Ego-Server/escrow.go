@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The hmac key ring can be backed up by splitting it into M-of-N Shamir
+// shares inside the enclave, each encrypted to the public key of an
+// offline custodian. To restore it, a freshly attested enclave started
+// with -key-import publishes an ephemeral import key; every custodian
+// checks its attestation, decrypts their share offline and re-encrypts it
+// to the import key (see runCustodian). Neither the shares nor the key
+// ring are ever readable by the host.
+
+// shareLabel and importLabel separate shares encrypted to a custodian from
+// shares encrypted to an importing enclave.
+const shareLabel = "passhield key share v1"
+const importLabel = "passhield key import v1"
+
+// encryptedShare is one Shamir share encrypted with AES-256-GCM under a
+// fresh key, which is encrypted with RSA-OAEP to the recipient.
+type encryptedShare struct {
+	Custodian  string `json:"custodian"`
+	Key        []byte `json:"key"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+func encryptShare(pub *rsa.PublicKey, label string, custodian string, share []byte) (encryptedShare, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return encryptedShare{}, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, []byte(label))
+	if err != nil {
+		return encryptedShare{}, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return encryptedShare{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return encryptedShare{}, err
+	}
+	return encryptedShare{
+		Custodian:  custodian,
+		Key:        encryptedKey,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, share, []byte(label+"\x00"+custodian)),
+	}, nil
+}
+
+func decryptShare(priv *rsa.PrivateKey, label string, s encryptedShare) ([]byte, error) {
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, s.Key, []byte(label))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("share has an invalid nonce")
+	}
+	return gcm.Open(nil, s.Nonce, s.Ciphertext, []byte(label+"\x00"+s.Custodian))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// keyFingerprint identifies a key ring without revealing it, so that a
+// restored ring can be checked against the export.
+func keyFingerprint(ring []byte) string {
+	hash := sha256.Sum256(append([]byte("passhield key ring\x00"), ring...))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyExport is the content of a backup.
+type keyExport struct {
+	Threshold   int              `json:"threshold"`
+	Current     string           `json:"current"`
+	Generations []string         `json:"generations"`
+	Fingerprint string           `json:"fingerprint"`
+	Created     time.Time        `json:"created"`
+	Shares      []encryptedShare `json:"shares"`
+}
+
+// exportBundle is what the export endpoint returns. Token is an
+// attestation token over the SHA-256 of Export, which custodians check
+// before accepting their share.
+type exportBundle struct {
+	Export json.RawMessage `json:"export"`
+	Token  string          `json:"token"`
+}
+
+// custodianKey is a custodian in the measured config: the name used in the
+// export and the PEM encoded public key its share is encrypted to.
+type custodianKey struct {
+	Name      string `json:"name"`
+	PublicKey string `json:"publicKey"`
+}
+
+// exportRequest may repeat the custodians and threshold of the export; it
+// is refused unless they are the pinned ones.
+type exportRequest struct {
+	Threshold  int            `json:"threshold"`
+	Custodians []custodianKey `json:"custodians"`
+}
+
+// parseCustodians checks the custodians of the measured config and returns
+// their public keys.
+func parseCustodians(custodians []custodianKey, threshold int) ([]*rsa.PublicKey, error) {
+	if len(custodians) == 0 {
+		return nil, nil
+	}
+	if threshold < 2 || threshold > len(custodians) || len(custodians) > 255 {
+		return nil, errors.New("custodianThreshold must be between 2 and the number of custodians (at most 255)")
+	}
+	pubs := make([]*rsa.PublicKey, len(custodians))
+	names := make(map[string]bool)
+	for i, c := range custodians {
+		if c.Name == "" || names[c.Name] {
+			return nil, errors.New("custodian names must be set and unique")
+		}
+		names[c.Name] = true
+		pub, err := parsePublicKey([]byte(c.PublicKey))
+		if err != nil {
+			return nil, fmt.Errorf("custodian %s: %v", c.Name, err)
+		}
+		if pub.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("custodian %s: key must have at least 2048 bits", c.Name)
+		}
+		pubs[i] = pub
+	}
+	return pubs, nil
+}
+
+// sameCustodians tells whether a request names exactly the pinned
+// custodians, in the same order.
+func sameCustodians(req exportRequest, custodians []custodianKey, pubs []*rsa.PublicKey, threshold int) bool {
+	if req.Threshold != threshold || len(req.Custodians) != len(custodians) {
+		return false
+	}
+	for i, c := range req.Custodians {
+		pub, err := parsePublicKey([]byte(c.PublicKey))
+		if err != nil || c.Name != custodians[i].Name || pub.N.Cmp(pubs[i].N) != 0 || pub.E != pubs[i].E {
+			return false
+		}
+	}
+	return true
+}
+
+// keyExportHandler runs the export ceremony: it splits the sealed key ring
+// into shares for the custodians pinned in the measured config and returns
+// the attested bundle. The admin token comes from the host as well as the
+// request, so the request cannot choose the custodians; a body naming
+// other ones is refused.
+func keyExportHandler(keys *keyRing, attester Attester, custodians []custodianKey, threshold int) http.HandlerFunc {
+	pubs, err := parseCustodians(custodians, threshold)
+	if err != nil {
+		// Validate checked them already
+		panic(err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		if len(pubs) == 0 {
+			http.Error(w, "No custodians are pinned in the measured config", http.StatusForbidden)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			var req exportRequest
+			if err := json.Unmarshal(body, &req); err != nil {
+				http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+				return
+			}
+			if !sameCustodians(req, custodians, pubs, threshold) {
+				http.Error(w, "Only the custodians and threshold of the measured config can receive shares", http.StatusForbidden)
+				return
+			}
+		}
+
+		ring, err := keys.marshal()
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to export the key ring", http.StatusInternalServerError)
+			return
+		}
+		shares, err := splitSecret(ring, len(pubs), threshold)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current, _ := keys.currentKey()
+		export := keyExport{
+			Threshold:   threshold,
+			Current:     current,
+			Generations: keys.generations(),
+			Fingerprint: keyFingerprint(ring),
+			Created:     time.Now().UTC(),
+		}
+		for i, share := range shares {
+			encrypted, err := encryptShare(pubs[i], shareLabel, custodians[i].Name, share)
+			if err != nil {
+				fmt.Println(err)
+				http.Error(w, "Failed to encrypt the shares", http.StatusInternalServerError)
+				return
+			}
+			export.Shares = append(export.Shares, encrypted)
+		}
+
+		payload, err := json.Marshal(export)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to export the key ring", http.StatusInternalServerError)
+			return
+		}
+		hash := sha256.Sum256(payload)
+		token, err := attester.Attest(hash[:])
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to attest the export", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🔑 Exported the hmac key ring as %d-of-%d shares\n", threshold, len(shares))
+		writeJSON(w, exportBundle{Export: payload, Token: token})
+	}
+}
+
+// importKey is what an importing enclave publishes. Token is an
+// attestation token over the SHA-256 of the DER encoded public key.
+type importKey struct {
+	PublicKey string `json:"publicKey"`
+	Token     string `json:"token"`
+}
+
+// importShare is a custodian's share re-encrypted to the import key,
+// together with the fingerprint of the exported ring it belongs to. The
+// custodian signs both with their pinned key, as the import key is public
+// and anyone can encrypt a share to it.
+type importShare struct {
+	Fingerprint string         `json:"fingerprint"`
+	Share       encryptedShare `json:"share"`
+	Signature   []byte         `json:"signature"`
+}
+
+// importSignatureLabel separates the custodians' import signatures
+const importSignatureLabel = "passhield key import signature v1"
+
+// digest is what the custodian signs: the import key the share is
+// encrypted to, the fingerprint and the encrypted share.
+func (s importShare) digest(importDER []byte) []byte {
+	h := sha256.New()
+	for _, field := range [][]byte{[]byte(importSignatureLabel), importDER, []byte(s.Fingerprint), []byte(s.Share.Custodian), s.Share.Key, s.Share.Nonce, s.Share.Ciphertext} {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		h.Write(length[:])
+		h.Write(field)
+	}
+	return h.Sum(nil)
+}
+
+// sign signs the share with the custodian's key.
+func (s *importShare) sign(key *rsa.PrivateKey, importDER []byte) error {
+	signature, err := rsa.SignPSS(rand.Reader, key, crypto.SHA256, s.digest(importDER), nil)
+	s.Signature = signature
+	return err
+}
+
+// importProgress is returned after every share.
+type importProgress struct {
+	Fingerprint string   `json:"fingerprint"`
+	Custodians  []string `json:"custodians"`
+	Complete    bool     `json:"complete"`
+}
+
+// keyImport collects the shares of one import ceremony. Its key exists
+// only in enclave memory, so shares encrypted to it can only be read by
+// this enclave instance. The custodians, threshold and the fingerprint of
+// the ring to restore come from the measured config.
+type keyImport struct {
+	mu          sync.Mutex
+	key         *rsa.PrivateKey
+	der         []byte
+	published   importKey
+	custodians  []custodianKey
+	pubs        []*rsa.PublicKey
+	threshold   int
+	fingerprint string
+	shares      map[string][]byte
+	done        chan []byte
+}
+
+// maxImportCombinations bounds the threshold sized subsets of the shares
+// tried for one new share
+const maxImportCombinations = 10000
+
+func newKeyImport(attester Attester, custodians []custodianKey, threshold int, fingerprint string) (*keyImport, error) {
+	pubs, err := parseCustodians(custodians, threshold)
+	if err != nil {
+		return nil, err
+	}
+	if len(pubs) == 0 || fingerprint == "" {
+		return nil, errors.New("a key import needs the custodians and keyImportFingerprint in the measured config")
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(der)
+	token, err := attester.Attest(hash[:])
+	if err != nil {
+		return nil, err
+	}
+	return &keyImport{
+		key:         key,
+		der:         der,
+		published:   importKey{PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), Token: token},
+		custodians:  custodians,
+		pubs:        pubs,
+		threshold:   threshold,
+		fingerprint: fingerprint,
+		shares:      make(map[string][]byte),
+		done:        make(chan []byte, 1),
+	}, nil
+}
+
+// add checks a share on its own and keeps it: it must be signed by the
+// pinned custodian it names, belong to the pinned fingerprint and carry
+// that custodian's share index. Then every threshold sized set of shares
+// with the new one is combined until one rebuilds the pinned ring, which
+// is sent on done; a wrong share cannot spoil the others.
+func (k *keyImport) add(s importShare) (importProgress, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	index := -1
+	for i, c := range k.custodians {
+		if c.Name == s.Share.Custodian {
+			index = i
+		}
+	}
+	if index < 0 {
+		return importProgress{}, errors.New("share of a custodian that is not pinned")
+	}
+	if rsa.VerifyPSS(k.pubs[index], crypto.SHA256, s.digest(k.der), s.Signature, nil) != nil {
+		return importProgress{}, errors.New("share is not signed by its custodian")
+	}
+	if s.Fingerprint != k.fingerprint {
+		return importProgress{}, errors.New("share belongs to a different export")
+	}
+	share, err := decryptShare(k.key, importLabel, s.Share)
+	if err != nil {
+		return importProgress{}, errors.New("share cannot be decrypted with the import key")
+	}
+	// the export gives the i-th custodian the share with x = i+1
+	if len(share) < 2 || int(share[0]) != index+1 {
+		return importProgress{}, errors.New("share does not have the index of its custodian")
+	}
+	k.shares[s.Share.Custodian] = share
+
+	progress := importProgress{Fingerprint: k.fingerprint}
+	var others [][]byte
+	for _, c := range k.custodians {
+		if _, ok := k.shares[c.Name]; ok {
+			progress.Custodians = append(progress.Custodians, c.Name)
+			if c.Name != s.Share.Custodian {
+				others = append(others, k.shares[c.Name])
+			}
+		}
+	}
+	if len(progress.Custodians) < k.threshold {
+		return progress, nil
+	}
+	var restored []byte
+	tries := 0
+	combineSubsets(others, k.threshold-1, [][]byte{share}, func(shares [][]byte) bool {
+		tries++
+		if ring, err := combineShares(shares); err == nil && keyFingerprint(ring) == k.fingerprint {
+			restored = ring
+		}
+		return restored != nil || tries >= maxImportCombinations
+	})
+	if restored != nil {
+		progress.Complete = true
+		select {
+		case k.done <- restored:
+		default:
+		}
+	}
+	return progress, nil
+}
+
+// combineSubsets calls try with chosen plus every n of the shares until try
+// returns true, and tells whether it did.
+func combineSubsets(shares [][]byte, n int, chosen [][]byte, try func([][]byte) bool) bool {
+	if n == 0 {
+		return try(chosen)
+	}
+	for i := 0; i+n <= len(shares); i++ {
+		if combineSubsets(shares[i+1:], n-1, append(append([][]byte(nil), chosen...), shares[i]), try) {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *keyImport) handler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, k.published)
+	case "POST":
+		var s importShare
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+		progress, err := k.add(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("🔑 Received the key share of %s\n", s.Share.Custodian)
+		writeJSON(w, progress)
+	default:
+		http.Error(w, "Only GET and POST requests are allowed", http.StatusBadRequest)
+	}
+}
+
+// runKeyImport serves only the import ceremony until the key ring has been
+// rebuilt, then seals and stores it. It refuses to replace a stored key
+// ring that this enclave can still unseal.
+func runKeyImport(cfg Config, tlsCfg *tls.Config, attester Attester, token *attestationToken, database Store, state *sealedState) error {
+	sealed, err := database.GetSealedHmacKey()
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if err == nil {
+		if _, err := state.Unseal(sealed); err == nil {
+			return errors.New("the stored hmac key can be unsealed, there is nothing to import")
+		}
+	}
+
+	ceremony, err := newKeyImport(attester, cfg.Custodians, cfg.CustodianThreshold, cfg.KeyImportFingerprint)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(token.get())) })
+	mux.HandleFunc("/admin/keys/import", requireAdmin(cfg.AdminTokenHash, ceremony.handler))
+	server := &http.Server{Addr: cfg.ServerAddr, TLSConfig: tlsCfg, Handler: mux}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServeTLS("", "") }()
+	fmt.Printf("🔑 Waiting for key shares on https://%s/admin/keys/import\n", cfg.ServerAddr)
+
+	var ring []byte
+	select {
+	case ring = <-ceremony.done:
+	case err := <-serveErr:
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println(err)
+	}
+
+	keys, err := unmarshalKeyRing(ring)
+	if err != nil {
+		return err
+	}
+	// the new state continues from the counter of this enclave
+	if err := state.restart(); err != nil {
+		return err
+	}
+	if err := stores_HmacKey(keys, database, state); err != nil {
+		return err
+	}
+	// the attempts and the attempt log were sealed by the old enclave and
+	// cannot be read anymore, every user starts with a full budget
+	if err := resetAttempts(database, state); err != nil {
+		return err
+	}
+	fmt.Printf("🔑 Imported hmac key ring with generations %v\n", keys.generations())
+	return nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// importFixture is an import ceremony for a 2-of-3 export of ring, with
+// the custodians' keys.
+type importFixture struct {
+	ring       []byte
+	shares     [][]byte
+	keys       []*rsa.PrivateKey
+	custodians []custodianKey
+	attester   Attester
+	ceremony   *keyImport
+}
+
+func newImportFixture(t *testing.T) importFixture {
+	dir, err := ioutil.TempDir("", "escrow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	attester, err := newLocalAttester(filepath.Join(dir, "attest.key"), 1234, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := importFixture{ring: []byte(`{"current":"1","keys":{"1":"a key ring of the test"}}`)}
+	var custodians []custodianKey
+	for _, name := range []string{"alice", "bob", "carol"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name+".pub")
+		if err := writePublicKey(file, &key.PublicKey); err != nil {
+			t.Fatal(err)
+		}
+		pub, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.keys = append(f.keys, key)
+		custodians = append(custodians, custodianKey{Name: name, PublicKey: string(pub)})
+	}
+	f.custodians = custodians
+	f.attester = attester
+	if f.shares, err = splitSecret(f.ring, 3, 2); err != nil {
+		t.Fatal(err)
+	}
+	if f.ceremony, err = newKeyImport(attester, custodians, 2, keyFingerprint(f.ring)); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// share reseals share for custodian name, signed by key.
+func (f importFixture) share(t *testing.T, name string, key *rsa.PrivateKey, share []byte) importShare {
+	encrypted, err := encryptShare(&f.ceremony.key.PublicKey, importLabel, name, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := importShare{Fingerprint: keyFingerprint(f.ring), Share: encrypted}
+	if err := s.sign(key, f.ceremony.der); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestKeyImport(t *testing.T) {
+	f := newImportFixture(t)
+	progress, err := f.ceremony.add(f.share(t, "alice", f.keys[0], f.shares[0]))
+	if err != nil || progress.Complete {
+		t.Fatalf("one share: %+v, %v", progress, err)
+	}
+	progress, err = f.ceremony.add(f.share(t, "carol", f.keys[2], f.shares[2]))
+	if err != nil || !progress.Complete {
+		t.Fatalf("two shares: %+v, %v", progress, err)
+	}
+	if ring := <-f.ceremony.done; string(ring) != string(f.ring) {
+		t.Errorf("restored %q", ring)
+	}
+}
+
+func TestKeyImportRejectsForgedShares(t *testing.T) {
+	f := newImportFixture(t)
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a ring of the attacker's choosing, split and encrypted to the public
+	// import key, with the fingerprint the attacker claims
+	forged := []byte(`{"current":"1","keys":{"1":"the attacker's key"}}`)
+	forgedShares, err := splitSecret(forged, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := f.share(t, "alice", forger, forgedShares[0])
+	unsigned.Signature = nil
+	wrongFingerprint := f.share(t, "alice", f.keys[0], f.shares[0])
+	wrongFingerprint.Fingerprint = keyFingerprint(forged)
+	if err := wrongFingerprint.sign(f.keys[0], f.ceremony.der); err != nil {
+		t.Fatal(err)
+	}
+	for name, s := range map[string]importShare{
+		"unsigned":                 unsigned,
+		"signed by another key":    f.share(t, "alice", forger, forgedShares[0]),
+		"signed by another holder": f.share(t, "alice", f.keys[1], f.shares[0]),
+		"unknown custodian":        f.share(t, "mallory", forger, forgedShares[0]),
+		"other fingerprint":        wrongFingerprint,
+		"index of another share":   f.share(t, "alice", f.keys[0], f.shares[1]),
+	} {
+		if _, err := f.ceremony.add(s); err == nil {
+			t.Errorf("%s: share accepted", name)
+		}
+	}
+	if len(f.ceremony.shares) != 0 {
+		t.Fatalf("%d rejected shares were kept", len(f.ceremony.shares))
+	}
+}
+
+func TestKeyImportSkipsWrongShare(t *testing.T) {
+	f := newImportFixture(t)
+	// a custodian signs a damaged share; it must not block the others
+	damaged := append([]byte(nil), f.shares[0]...)
+	damaged[5] ^= 0xff
+	for i, s := range []importShare{
+		f.share(t, "alice", f.keys[0], damaged),
+		f.share(t, "bob", f.keys[1], f.shares[1]),
+	} {
+		progress, err := f.ceremony.add(s)
+		if err != nil || progress.Complete {
+			t.Fatalf("share %d: %+v, %v", i, progress, err)
+		}
+	}
+	progress, err := f.ceremony.add(f.share(t, "carol", f.keys[2], f.shares[2]))
+	if err != nil || !progress.Complete {
+		t.Fatalf("third share: %+v, %v", progress, err)
+	}
+	if ring := <-f.ceremony.done; !strings.Contains(string(ring), "a key ring of the test") {
+		t.Errorf("restored %q", ring)
+	}
+}
+
+// TestKeyExport checks that the export only goes to the pinned custodians
+// and that their shares rebuild the ring of the fingerprint.
+func TestKeyExport(t *testing.T) {
+	f := newImportFixture(t)
+	keys := &keyRing{current: "1", keys: map[string][]byte{"1": []byte("0123456789abcdef0123456789abcdef")}}
+	export := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/admin/keys/export", strings.NewReader(body)))
+		return w
+	}
+	if w := export(keyExportHandler(keys, f.attester, nil, 0), ""); w.Code != http.StatusForbidden {
+		t.Errorf("export without pinned custodians: %d", w.Code)
+	}
+	handler := keyExportHandler(keys, f.attester, f.custodians, 2)
+	other := append([]custodianKey{{Name: "mallory", PublicKey: f.custodians[0].PublicKey}}, f.custodians[1:]...)
+	body, err := json.Marshal(exportRequest{Threshold: 2, Custodians: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := export(handler, string(body)); w.Code != http.StatusForbidden {
+		t.Errorf("export to other custodians: %d", w.Code)
+	}
+
+	w := export(handler, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("export: %d %s", w.Code, w.Body)
+	}
+	var bundle exportBundle
+	if err := json.Unmarshal(w.Body.Bytes(), &bundle); err != nil {
+		t.Fatal(err)
+	}
+	var exported keyExport
+	if err := json.Unmarshal(bundle.Export, &exported); err != nil {
+		t.Fatal(err)
+	}
+	var shares [][]byte
+	for i, s := range exported.Shares[1:] {
+		share, err := decryptShare(f.keys[i+1], shareLabel, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares = append(shares, share)
+	}
+	ring, err := combineShares(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyFingerprint(ring) != exported.Fingerprint {
+		t.Error("the shares do not rebuild the exported ring")
+	}
+	if _, err := decryptShare(f.keys[0], shareLabel, exported.Shares[1]); err == nil {
+		t.Error("a custodian decrypts the share of another")
+	}
+}
@@ -4,6 +4,9 @@ go 1.14
 
 require (
 	github.com/edgelesssys/ego v0.4.1
-	github.com/mattn/go-sqlite3 v1.14.16 // indirect
-	gopkg.in/square/go-jose.v2 v2.6.0 // indirect
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.16
+	golang.org/x/crypto v0.14.0
+	golang.org/x/text v0.13.0
+	gopkg.in/square/go-jose.v2 v2.6.0
 )
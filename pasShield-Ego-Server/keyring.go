@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// hmacKeyLength is the number of random characters of a new hmac key
+const hmacKeyLength = 128
+
+// keyRing holds every generation of the hmac key. New records are written
+// under the current generation; older generations are only kept to verify
+// records that were not re-keyed yet. Generations are numbered "1", "2", ...
+type keyRing struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+	// changeMu serializes the changes, which are saved before they are used
+	changeMu sync.Mutex
+}
+
+// sealedKeyRing is the form of the key ring that is sealed and stored.
+type sealedKeyRing struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// newKeyRing generates the first key generation. The caller stores the
+// ring before it is used.
+func newKeyRing() (*keyRing, error) {
+	k := &keyRing{keys: make(map[string][]byte)}
+	if _, err := k.rotate(func(data []byte) error { return nil }); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// unmarshalKeyRing parses an unsealed key ring. Releases before key
+// rotation sealed the bare key, which becomes generation "1".
+func unmarshalKeyRing(data []byte) (*keyRing, error) {
+	var sealed sealedKeyRing
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return &keyRing{current: "1", keys: map[string][]byte{"1": data}}, nil
+	}
+	if _, ok := sealed.Keys[sealed.Current]; !ok {
+		return nil, errors.New("key ring has no current key")
+	}
+	return &keyRing{current: sealed.Current, keys: sealed.Keys}, nil
+}
+
+func (k *keyRing) marshal() ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return json.Marshal(sealedKeyRing{Current: k.current, Keys: k.keys})
+}
+
+// currentKey returns the generation and key new records are written with.
+func (k *keyRing) currentKey() (string, []byte) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.keys[k.current]
+}
+
+// key returns the key of the given generation.
+func (k *keyRing) key(kid string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, errors.New("hmac key " + kid + " does not exist or was retired")
+	}
+	return key, nil
+}
+
+// generations returns the ids of all keys in the ring in ascending order.
+func (k *keyRing) generations() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	return ids
+}
+
+// change applies apply to a copy of the ring and passes the marshaled copy
+// to save, which seals and stores it. Only then the copy replaces the ring
+// in use, so no record is written under a key that is not stored yet, and
+// if apply or save fails the ring stays as it was. A nil apply saves the
+// ring as it is.
+func (k *keyRing) change(apply func(ring *sealedKeyRing) error, save func(data []byte) error) error {
+	k.changeMu.Lock()
+	defer k.changeMu.Unlock()
+	k.mu.RLock()
+	ring := sealedKeyRing{Current: k.current, Keys: make(map[string][]byte, len(k.keys)+1)}
+	for id, key := range k.keys {
+		ring.Keys[id] = key
+	}
+	k.mu.RUnlock()
+	if apply != nil {
+		if err := apply(&ring); err != nil {
+			return err
+		}
+	}
+	data, err := json.Marshal(ring)
+	if err != nil {
+		return err
+	}
+	if err := save(data); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.current, k.keys = ring.Current, ring.Keys
+	return nil
+}
+
+// rotate generates a new key generation inside the enclave and makes it
+// the current one once save stored it. Older generations stay in the ring
+// until retired.
+func (k *keyRing) rotate(save func(data []byte) error) (string, error) {
+	random_hmackey, err := GenerateRandomString(hmacKeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	var kid string
+	err = k.change(func(ring *sealedKeyRing) error {
+		next := 1
+		for id := range ring.Keys {
+			if n, err := strconv.Atoi(id); err == nil && n >= next {
+				next = n + 1
+			}
+		}
+		kid = strconv.Itoa(next)
+		ring.Current = kid
+		ring.Keys[kid] = []byte(random_hmackey)
+		return nil
+	}, save)
+	if err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+// retire removes a key generation once save stored the ring without it.
+// The current generation cannot be retired, and records that still need a
+// retired key, also as the inner layer of a wrap, cannot log in.
+func (k *keyRing) retire(kid string, save func(data []byte) error) error {
+	return k.change(func(ring *sealedKeyRing) error {
+		if kid == ring.Current {
+			return errors.New("the current hmac key cannot be retired")
+		}
+		if _, ok := ring.Keys[kid]; !ok {
+			return errors.New("hmac key " + kid + " does not exist")
+		}
+		delete(ring.Keys, kid)
+		return nil
+	}, save)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestKeyRingChangeSavedFirst checks that a rotation or retirement only
+// takes effect once the ring is saved, and not at all if saving fails.
+func TestKeyRingChangeSavedFirst(t *testing.T) {
+	keys, err := newKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failing := func(data []byte) error { return errors.New("database is down") }
+	if _, err := keys.rotate(failing); err == nil {
+		t.Fatal("rotate succeeded although the ring was not saved")
+	}
+	if current, _ := keys.currentKey(); current != "1" || len(keys.generations()) != 1 {
+		t.Fatalf("a failed rotation left generation %s of %v in use", current, keys.generations())
+	}
+
+	var saved *keyRing
+	inUse := "1"
+	save := func(data []byte) error {
+		// the ring in use still has the old generation while it is saved
+		if current, _ := keys.currentKey(); current != inUse {
+			t.Errorf("generation %s is current before the ring is saved", current)
+		}
+		saved, err = unmarshalKeyRing(data)
+		return err
+	}
+	kid, err := keys.rotate(save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := keys.currentKey(); current != kid || kid != "2" {
+		t.Fatalf("current generation is %s after rotating to %s", current, kid)
+	}
+	if current, _ := saved.currentKey(); current != kid {
+		t.Errorf("the saved ring has current generation %s, want %s", current, kid)
+	}
+	inUse = kid
+
+	if err := keys.retire("1", failing); err == nil {
+		t.Fatal("retire succeeded although the ring was not saved")
+	}
+	if _, err := keys.key("1"); err != nil {
+		t.Errorf("a failed retirement removed the key: %v", err)
+	}
+	if err := keys.retire("2", save); err == nil {
+		t.Error("the current generation was retired")
+	}
+	if err := keys.retire("1", save); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.key("1"); err == nil {
+		t.Error("the retired key is still in the ring")
+	}
+}
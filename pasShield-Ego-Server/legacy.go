@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blowfish"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// legacyHash is the password hashing scheme of an imported account. The
+// record's mac is computed over the legacy digest instead of the password,
+// so login recomputes the legacy digest inside the enclave first. Its
+// string form is the record's legacy parameter:
+//
+//	werkzeug,sha256,<salt>                  hmac(salt, password)
+//	werkzeug,pbkdf2:sha256:260000,<salt>    pbkdf2(password, salt)
+//	werkzeug,scrypt:32768:8:1,<salt>        scrypt(password, salt)
+//	bcrypt,2b,12,<salt>
+type legacyHash struct {
+	Scheme string // werkzeug or bcrypt
+	Method string // werkzeug method or bcrypt version
+	Cost   int    // bcrypt
+	Salt   string
+}
+
+// upper bounds of the legacy costs; like the pre-hash parameters they come
+// from the host and must not let one login stall the enclave
+const (
+	maxPBKDF2Iterations = 2000000
+	maxBcryptCost       = 16
+)
+
+// werkzeugHashes are the hash functions werkzeug methods may name.
+var werkzeugHashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha224": sha256.New224,
+	"sha256": sha256.New,
+	"sha384": sha512.New384,
+	"sha512": sha512.New,
+}
+
+// bcryptEncoding is the base64 alphabet of bcrypt, without padding.
+var bcryptEncoding = base64.NewEncoding("./ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789").WithPadding(base64.NoPadding)
+
+// parseLegacyHash splits a hash from a legacy user table into its scheme
+// and digest. It understands werkzeug's generate_password_hash output,
+// e.g. sha256$<salt>$<hex>, and bcrypt hashes, $2b$12$<salt><hash>.
+func parseLegacyHash(stored string) (*legacyHash, string, error) {
+	if strings.HasPrefix(stored, "$2") {
+		fields := strings.Split(stored, "$")
+		if len(fields) != 4 || len(fields[3]) != 53 {
+			return nil, "", errors.New("malformed bcrypt hash")
+		}
+		cost, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, "", errors.New("malformed bcrypt cost")
+		}
+		legacy := &legacyHash{Scheme: "bcrypt", Method: fields[1], Cost: cost, Salt: fields[3][:22]}
+		if err := legacy.validate(); err != nil {
+			return nil, "", err
+		}
+		return legacy, fields[3][22:], nil
+	}
+
+	fields := strings.Split(stored, "$")
+	if len(fields) != 3 {
+		return nil, "", errors.New("neither a werkzeug nor a bcrypt hash")
+	}
+	legacy := &legacyHash{Scheme: "werkzeug", Method: fields[0], Salt: fields[1]}
+	if err := legacy.validate(); err != nil {
+		return nil, "", err
+	}
+	if _, err := hex.DecodeString(fields[2]); err != nil {
+		return nil, "", errors.New("werkzeug digest is not hex")
+	}
+	return legacy, fields[2], nil
+}
+
+// parseLegacySpec parses the legacy parameter of a record.
+func parseLegacySpec(spec string) (*legacyHash, error) {
+	fields := strings.Split(spec, ",")
+	var legacy *legacyHash
+	switch {
+	case fields[0] == "werkzeug" && len(fields) == 3:
+		legacy = &legacyHash{Scheme: "werkzeug", Method: fields[1], Salt: fields[2]}
+	case fields[0] == "bcrypt" && len(fields) == 4:
+		cost, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, errors.New("malformed bcrypt cost")
+		}
+		legacy = &legacyHash{Scheme: "bcrypt", Method: fields[1], Cost: cost, Salt: fields[3]}
+	default:
+		return nil, fmt.Errorf("malformed legacy scheme %q", spec)
+	}
+	return legacy, legacy.validate()
+}
+
+func (l *legacyHash) String() string {
+	if l.Scheme == "bcrypt" {
+		return fmt.Sprintf("bcrypt,%s,%d,%s", l.Method, l.Cost, l.Salt)
+	}
+	return fmt.Sprintf("werkzeug,%s,%s", l.Method, l.Salt)
+}
+
+// validate checks that the scheme can be recomputed and that its string
+// form fits into a record.
+func (l *legacyHash) validate() error {
+	if strings.ContainsAny(l.Salt, "$,") || l.Salt == "" {
+		return errors.New("legacy salt is empty or contains $ or ,")
+	}
+	switch l.Scheme {
+	case "bcrypt":
+		if l.Method != "2a" && l.Method != "2b" && l.Method != "2y" {
+			return errors.New("unsupported bcrypt version " + l.Method)
+		}
+		if l.Cost < 4 || l.Cost > maxBcryptCost {
+			return fmt.Errorf("bcrypt cost must be between 4 and %d", maxBcryptCost)
+		}
+		if salt, err := bcryptEncoding.DecodeString(l.Salt); err != nil || len(salt) != 16 {
+			return errors.New("malformed bcrypt salt")
+		}
+		return nil
+	case "werkzeug":
+		_, _, _, err := l.werkzeugMethod()
+		return err
+	}
+	return errors.New("unknown legacy scheme " + l.Scheme)
+}
+
+// werkzeugMethod splits a werkzeug method such as pbkdf2:sha256:260000
+// into its name, hash function and numeric parameters.
+func (l *legacyHash) werkzeugMethod() (string, func() hash.Hash, []int, error) {
+	parts := strings.Split(l.Method, ":")
+	var numbers []string
+	var h func() hash.Hash
+	switch parts[0] {
+	case "pbkdf2":
+		// pbkdf2:<hash>:<iterations>
+		if len(parts) != 3 || werkzeugHashes[parts[1]] == nil {
+			return "", nil, nil, fmt.Errorf("werkzeug method %q needs a hash and iterations", l.Method)
+		}
+		h, numbers = werkzeugHashes[parts[1]], parts[2:]
+	case "scrypt":
+		// scrypt:<n>:<r>:<p>
+		if len(parts) != 4 {
+			return "", nil, nil, fmt.Errorf("werkzeug method %q needs n, r and p", l.Method)
+		}
+		numbers = parts[1:]
+	default:
+		// a plain hash name means hmac(salt, password)
+		if len(parts) != 1 || werkzeugHashes[parts[0]] == nil {
+			return "", nil, nil, fmt.Errorf("unsupported werkzeug method %q", l.Method)
+		}
+		h = werkzeugHashes[parts[0]]
+	}
+	params := make([]int, len(numbers))
+	for i, number := range numbers {
+		n, err := strconv.Atoi(number)
+		if err != nil || n < 1 {
+			return "", nil, nil, fmt.Errorf("malformed werkzeug method %q", l.Method)
+		}
+		params[i] = n
+	}
+	switch parts[0] {
+	case "pbkdf2":
+		if params[0] > maxPBKDF2Iterations {
+			return "", nil, nil, fmt.Errorf("werkzeug pbkdf2 allows at most %d iterations", maxPBKDF2Iterations)
+		}
+	case "scrypt":
+		if err := checkScrypt(params[0], params[1], params[2]); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	return parts[0], h, params, nil
+}
+
+// apply recomputes the legacy digest of password in the form it had in
+// the legacy table: hex for werkzeug, the 31 character hash for bcrypt.
+func (l *legacyHash) apply(password []byte) ([]byte, error) {
+	if l.Scheme == "bcrypt" {
+		return bcryptHash(password, l.Cost, l.Salt)
+	}
+	name, h, params, err := l.werkzeugMethod()
+	if err != nil {
+		return nil, err
+	}
+	salt := []byte(l.Salt)
+	var digest []byte
+	switch name {
+	case "pbkdf2":
+		digest = pbkdf2.Key(password, salt, params[0], h().Size(), h)
+	case "scrypt":
+		if digest, err = scrypt.Key(password, salt, params[0], params[1], params[2], 64); err != nil {
+			return nil, err
+		}
+	default:
+		mac := hmac.New(h, salt)
+		mac.Write(password)
+		digest = mac.Sum(nil)
+	}
+	return []byte(hex.EncodeToString(digest)), nil
+}
+
+// bcryptHash is bcrypt with a given salt, which golang.org/x/crypto/bcrypt
+// does not offer. It returns the 31 character hash after the salt.
+func bcryptHash(password []byte, cost int, encodedSalt string) ([]byte, error) {
+	salt, err := bcryptEncoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, err
+	}
+	// the key includes the terminating NUL and is cut at 72 bytes
+	key := append(append([]byte(nil), password...), 0)
+	if len(key) > 72 {
+		key = key[:72]
+	}
+	c, err := blowfish.NewSaltedCipher(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 1<<uint(cost); i++ {
+		blowfish.ExpandKey(key, c)
+		blowfish.ExpandKey(salt, c)
+	}
+	data := []byte("OrpheanBeholderScryDoubt")
+	for i := 0; i < 24; i += 8 {
+		for j := 0; j < 64; j++ {
+			c.Encrypt(data[i:i+8], data[i:i+8])
+		}
+	}
+	// only 23 of the 24 bytes are encoded, like every bcrypt does
+	return []byte(bcryptEncoding.EncodeToString(data[:23])), nil
+}
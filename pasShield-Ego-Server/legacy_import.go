@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// legacyUser is one row of a legacy user table.
+type legacyUser struct {
+	Username string `json:"username"`
+	Hash     string `json:"hash"`
+}
+
+// legacyImportResult reports what happened to a batch of legacy users.
+type legacyImportResult struct {
+	Imported int               `json:"imported"`
+	Failed   map[string]string `json:"failed,omitempty"`
+}
+
+// legacyImportHandler stores the legacy hashes of the users in the request
+// body as records whose mac covers the legacy digest, so the users can log
+// in with their old passwords. Users that already exist are reported as
+// failed and left alone; any other store error stops the batch with 500.
+func legacyImportHandler(keys *keyRing, database UserStore, policy recordPolicy, attempts *attemptLog, saltSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		var users []legacyUser
+		if err := json.NewDecoder(r.Body).Decode(&users); err != nil {
+			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
+			return
+		}
+		result := legacyImportResult{Failed: make(map[string]string)}
+		for _, user := range users {
+			if user.Username == "" {
+				continue
+			}
+			legacy, digest, err := parseLegacyHash(user.Hash)
+			if err != nil {
+				result.Failed[user.Username] = err.Error()
+				continue
+			}
+			salt := generateRandomSalt(saltSize)
+			record, err := createLegacyRecord(user.Username, legacy, digest, salt, keys, policy)
+			if err != nil {
+				result.Failed[user.Username] = err.Error()
+				continue
+			}
+			err = database.AddSaltAndHmac(user.Username, record.String(), salt)
+			if err == ErrExists {
+				result.Failed[user.Username] = err.Error()
+				continue
+			}
+			if err != nil {
+				// the users before this one are imported, a retry of the
+				// batch reports them as already existing
+				fmt.Println(err)
+				fmt.Printf("📥 Imported %d legacy users before the store failed\n", result.Imported)
+				http.Error(w, "Failed to store the user "+user.Username, http.StatusInternalServerError)
+				return
+			}
+			if err := attempts.fill(bucketKey(record)); err != nil {
+				fmt.Println(err)
+			}
+			result.Imported++
+		}
+		fmt.Printf("📥 Imported %d legacy users, %d failed\n", result.Imported, len(result.Failed))
+		writeJSON(w, result)
+	}
+}
+
+// identifier matches the table and column names runLegacyImport accepts.
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// runLegacyImport reads the users of a legacy sqlite user table, such as
+// the Users table of the Flask server, and sends them in batches to
+// /admin/users/import of an attested enclave. It runs on the host:
+//
+//	server legacy-import -db database.db -url https://localhost:8080 -admin-token <token> -signer <MRSIGNER>
+func runLegacyImport(args []string) error {
+	fs := flag.NewFlagSet("legacy-import", flag.ContinueOnError)
+	dbFile := fs.String("db", "database.db", "sqlite database with the legacy user table")
+	table := fs.String("table", "Users", "legacy user table")
+	usernameColumn := fs.String("username-column", "username", "column with the username")
+	hashColumn := fs.String("hash-column", "password", "column with the password hash")
+	serverURL := fs.String("url", "https://localhost:8080", "URL of the pasShield server")
+	adminToken := fs.String("admin-token", "", "admin token of the pasShield server")
+	batchSize := fs.Int("batch", adminPageSize, "users per request")
+	attesterName := fs.String("attester", "azure", "attester of the enclave: azure or local")
+	providerURL := fs.String("attestation-provider", defaultConfig().AttestationProviderURL, "URL of the Azure attestation provider")
+	attestPub := fs.String("attest-pub", "attest.key.pub", "public key of the local attester")
+	signer := fs.String("signer", "", "expected signer id (MRSIGNER) of the enclave, hex")
+	uniqueID := fs.String("unique-id", "", "expected unique id (MRENCLAVE) of the enclave, hex (optional)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *signer == "" || *adminToken == "" || *batchSize < 1 {
+		return errors.New("-signer, -admin-token and a positive -batch must be set")
+	}
+	for _, name := range []string{*table, *usernameColumn, *hashColumn} {
+		if !identifier.MatchString(name) {
+			return fmt.Errorf("invalid table or column name %q", name)
+		}
+	}
+
+	// the hashes are only sent to an enclave that passes attestation
+	verifier, err := newVerifier(*attesterName, *providerURL, *attestPub)
+	if err != nil {
+		return err
+	}
+	client, err := attestedClient(verifier, *serverURL, *signer, *uniqueID)
+	if err != nil {
+		return err
+	}
+
+	legacyDB, err := sql.Open("sqlite3", *dbFile)
+	if err != nil {
+		return err
+	}
+	defer legacyDB.Close()
+	rows, err := legacyDB.Query(fmt.Sprintf(`SELECT "%s", "%s" FROM "%s"`, *usernameColumn, *hashColumn, *table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var total legacyImportResult
+	total.Failed = make(map[string]string)
+	batch := make([]legacyUser, 0, *batchSize)
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", strings.TrimSuffix(*serverURL, "/")+"/admin/users/import", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+*adminToken)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		var result legacyImportResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return err
+		}
+		total.Imported += result.Imported
+		for username, reason := range result.Failed {
+			total.Failed[username] = reason
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for rows.Next() {
+		var user legacyUser
+		if err := rows.Scan(&user.Username, &user.Hash); err != nil {
+			return err
+		}
+		batch = append(batch, user)
+		if len(batch) == *batchSize {
+			if err := send(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := send(); err != nil {
+		return err
+	}
+
+	for username, reason := range total.Failed {
+		fmt.Printf("❌ %s: %s\n", username, reason)
+	}
+	fmt.Printf("📥 Imported %d legacy users, %d failed\n", total.Imported, len(total.Failed))
+	return nil
+}
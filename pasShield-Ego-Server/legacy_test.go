@@ -0,0 +1,81 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// known answers of werkzeug's generate_password_hash for the password
+// "correct horse" and the salt "saltsalt1234", computed with hashlib
+var werkzeugVectors = []string{
+	"sha256$saltsalt1234$b0981ef6f9968ca86e1b5fc1c9cb59878e5e1d3cfdde3ddc837b1016d36a266a",
+	"pbkdf2:sha256:1000$saltsalt1234$bc2a305a2d5d0745a41e7f7a6e52829cbd8e1bcde48f1471bf2e1f4dde879b6f",
+	"pbkdf2:sha1:2000$saltsalt1234$9f1ce14d4db7bc0f45e97977a6494e4e1fbd95a3",
+	"scrypt:1024:8:1$saltsalt1234$f59ac3adc7a015302b2ec858604848ead8f7caebbe0993f9ad7ecd75eff1d61c67e04194731283b0ab1453376b61b743f3df972e419528fb072a0c505822a9e0",
+}
+
+func TestWerkzeugVectors(t *testing.T) {
+	for _, stored := range werkzeugVectors {
+		legacy, digest, err := parseLegacyHash(stored)
+		if err != nil {
+			t.Fatalf("%s: %v", stored, err)
+		}
+		got, err := legacy.apply([]byte("correct horse"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != digest {
+			t.Errorf("%s: digest %s", stored, got)
+		}
+		if wrong, _ := legacy.apply([]byte("correct horsf")); string(wrong) == digest {
+			t.Errorf("%s: a wrong password gives the digest", stored)
+		}
+	}
+}
+
+func TestBcryptVectors(t *testing.T) {
+	// a vector of the OpenBSD test suite, and one of x/crypto/bcrypt
+	generated, err := bcrypt.GenerateFromPassword([]byte("correct horse"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for password, stored := range map[string]string{
+		"U*U":           "$2a$05$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"correct horse": string(generated),
+	} {
+		legacy, digest, err := parseLegacyHash(stored)
+		if err != nil {
+			t.Fatalf("%s: %v", stored, err)
+		}
+		got, err := legacy.apply([]byte(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != digest {
+			t.Errorf("%s: hash %s", stored, got)
+		}
+	}
+}
+
+func TestLegacyCostCaps(t *testing.T) {
+	for _, stored := range []string{
+		"$2b$31$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"$2b$17$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW",
+		"pbkdf2:sha256:2000001$saltsalt1234$bc2a305a2d5d0745a41e7f7a6e52829cbd8e1bcde48f1471bf2e1f4dde879b6f",
+		"scrypt:1048576:8:1$saltsalt1234$f59ac3adc7a015302b2ec858604848ead8f7caebbe0993f9ad7ecd75eff1d61c67e04194731283b0ab1453376b61b743f3df972e419528fb072a0c505822a9e0",
+		"scrypt:1024:8:17$saltsalt1234$f59ac3adc7a015302b2ec858604848ead8f7caebbe0993f9ad7ecd75eff1d61c67e04194731283b0ab1453376b61b743f3df972e419528fb072a0c505822a9e0",
+	} {
+		if _, _, err := parseLegacyHash(stored); err == nil {
+			t.Errorf("%s: accepted", stored)
+		}
+	}
+	// a record's legacy spec is checked the same way
+	if _, err := parseLegacySpec("bcrypt,2b,31,CCCCCCCCCCCCCCCCCCCCC."); err == nil || !strings.Contains(err.Error(), "cost") {
+		t.Errorf("bcrypt spec of cost 31: %v", err)
+	}
+	if _, _, err := parseLegacyHash("$2b$16$CCCCCCCCCCCCCCCCCCCCC.E5YPO9kmyuRGyh0XouQYb4YMJKvyOeW"); err != nil {
+		t.Errorf("bcrypt cost 16: %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// limiterPruneSize is the number of tracked clients above which a limiter
+// drops the buckets that are full again
+const limiterPruneSize = 4096
+
+// limiterSpec configures one guessing limiter. Its string form is
+//
+//	reject,capacity=20,refill=1m,v4=32,v6=64,status=429
+//	delay,capacity=100,refill=10ms,max-delay=2s,status=503
+//
+// reject answers with status right away when the bucket is empty; delay
+// reserves the next free guess and holds the request once until it is
+// regained, or answers with status if that is more than max-delay away. v4 and v6 are the prefix
+// lengths that group client addresses, e.g. v4=24 limits a /24 subnet as a
+// whole; they are ignored by the global limiter.
+type limiterSpec struct {
+	Response string
+	Limits   bucketLimits
+	V4       int
+	V6       int
+	Status   int
+	MaxDelay time.Duration
+}
+
+// parseLimiterSpec parses a limiter spec. An empty spec or "none"
+// disables the limiter and returns nil.
+func parseLimiterSpec(spec string) (*limiterSpec, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	fields := strings.Split(spec, ",")
+	l := &limiterSpec{Response: fields[0], V4: 32, V6: 64, Status: http.StatusTooManyRequests}
+	if l.Response != "reject" && l.Response != "delay" {
+		return nil, errors.New("unknown limiter response: " + l.Response)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed limiter parameter %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "refill":
+			l.Limits.Refill, err = time.ParseDuration(kv[1])
+		case "max-delay":
+			l.MaxDelay, err = time.ParseDuration(kv[1])
+		case "capacity":
+			l.Limits.Capacity, err = strconv.Atoi(kv[1])
+		case "v4":
+			l.V4, err = strconv.Atoi(kv[1])
+		case "v6":
+			l.V6, err = strconv.Atoi(kv[1])
+		case "status":
+			l.Status, err = strconv.Atoi(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown limiter parameter %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed limiter parameter %q", field)
+		}
+	}
+	if l.Limits.Capacity < 1 || l.Limits.Refill <= 0 {
+		return nil, errors.New("a limiter needs a positive capacity and refill")
+	}
+	if l.V4 < 0 || l.V4 > 32 || l.V6 < 0 || l.V6 > 128 {
+		return nil, errors.New("limiter prefixes must be within v4=0..32 and v6=0..128")
+	}
+	if l.Status < 400 || l.Status > 599 {
+		return nil, errors.New("limiter status must be an HTTP error status")
+	}
+	return l, nil
+}
+
+// limiter keeps a token bucket per client group, or a single one for the
+// global limiter. Unlike the account buckets these live only in memory:
+// they guard against clients on the network, not against the host, which
+// can pick any client address anyway.
+type limiter struct {
+	name    string
+	spec    limiterSpec
+	mu      sync.Mutex
+	buckets map[string]bucket
+	pruneAt int
+}
+
+func newLimiter(name string, spec *limiterSpec) *limiter {
+	if spec == nil {
+		return nil
+	}
+	return &limiter{name: name, spec: *spec, buckets: make(map[string]bucket), pruneAt: limiterPruneSize}
+}
+
+// key groups ip by the prefix lengths of the limiter.
+func (l *limiter) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/%d", ip4.Mask(net.CIDRMask(l.spec.V4, 32)), l.spec.V4)
+	}
+	return fmt.Sprintf("%s/%d", ip.Mask(net.CIDRMask(l.spec.V6, 128)), l.spec.V6)
+}
+
+// take removes one guess from the bucket of key and returns how long the
+// caller has to wait for it. An empty bucket of a delay limiter lends the
+// guess from the future as long as the wait stays within max-delay, so
+// concurrent requests queue up behind each other instead of racing for the
+// next token. Otherwise take returns false and the wait until the next
+// guess is regained.
+func (l *limiter) take(key string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = l.spec.Limits.fullBucket(now)
+	}
+	b = b.refill(l.spec.Limits, now)
+	var wait time.Duration
+	if b.Tokens <= 0 {
+		// Tokens below zero are guesses lent to waiting requests
+		wait = b.Refilled.Add(time.Duration(1-b.Tokens) * l.spec.Limits.Refill).Sub(now)
+		if l.spec.Response != "delay" || wait > l.spec.MaxDelay {
+			return b.Refilled.Add(l.spec.Limits.Refill).Sub(now), false
+		}
+	}
+	b.Tokens--
+	l.buckets[key] = b
+	if len(l.buckets) >= l.pruneAt {
+		l.prune(now)
+	}
+	return wait, true
+}
+
+// prune drops the buckets that are full again, which is the same as not
+// tracking them.
+func (l *limiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if b.refill(l.spec.Limits, now).Tokens >= l.spec.Limits.Capacity {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruneAt = len(l.buckets) * 2
+	if l.pruneAt < limiterPruneSize {
+		l.pruneAt = limiterPruneSize
+	}
+}
+
+// allow takes a guess for key and applies the limiter's response. It
+// returns false after writing the error response.
+func (l *limiter) allow(w http.ResponseWriter, key string) bool {
+	wait, ok := l.take(key)
+	if ok {
+		time.Sleep(wait)
+		return true
+	}
+	fmt.Printf("🚦 %s limit reached for %s\n", l.name, key)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, "Too many login attempts, try again later", l.spec.Status)
+	return false
+}
+
+// guessLimiters limit the password guesses of clients and subnets and of
+// all clients together, on top of the per-account buckets, so that
+// spreading guesses over many accounts does not help.
+type guessLimiters struct {
+	client  *limiter
+	subnet  *limiter
+	global  *limiter
+	trusted []*net.IPNet
+}
+
+func newGuessLimiters(cfg Config) (*guessLimiters, error) {
+	g := &guessLimiters{}
+	for _, limit := range []struct {
+		name string
+		spec string
+		l    **limiter
+	}{{"client", cfg.ClientLimit, &g.client}, {"subnet", cfg.SubnetLimit, &g.subnet}, {"global", cfg.GlobalLimit, &g.global}} {
+		spec, err := parseLimiterSpec(limit.spec)
+		if err != nil {
+			return nil, fmt.Errorf("%sLimit: %v", limit.name, err)
+		}
+		*limit.l = newLimiter(limit.name, spec)
+	}
+	trusted, err := parseTrustedProxies(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	g.trusted = trusted
+	return g, nil
+}
+
+// allow takes a guess from every limiter, the client's first, and returns
+// false after writing the error response of the first one that is empty.
+func (g *guessLimiters) allow(w http.ResponseWriter, r *http.Request) bool {
+	ip := clientIP(r, g.trusted)
+	if g.client != nil && !g.client.allow(w, g.client.key(ip)) {
+		return false
+	}
+	if g.subnet != nil && !g.subnet.allow(w, g.subnet.key(ip)) {
+		return false
+	}
+	if g.global != nil && !g.global.allow(w, "all clients") {
+		return false
+	}
+	return true
+}
+
+// parseTrustedProxies parses CIDRs or single addresses.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q: %v", proxy, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func trustedProxy(ip net.IP, trusted []*net.IPNet) bool {
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client. If the request comes from a
+// trusted proxy the X-Forwarded-For entries are walked from the right, and
+// the first one that is not a trusted proxy is the client; entries left of
+// it were written by the client and can be forged.
+func clientIP(r *http.Request, trusted []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return net.IPv4zero
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && trustedProxy(ip, trusted); i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
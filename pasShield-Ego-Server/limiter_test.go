@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestLimiterDelayReserves checks that a delay limiter hands out the
+// guesses of the future in turn and rejects once the wait would exceed
+// max-delay.
+func TestLimiterDelayReserves(t *testing.T) {
+	spec, err := parseLimiterSpec("delay,capacity=1,refill=1h,max-delay=3h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter("test", spec)
+	var last time.Duration
+	for i := 0; i < 4; i++ {
+		wait, ok := l.take("client")
+		if !ok {
+			t.Fatalf("take %d was rejected", i)
+		}
+		if i > 0 && (wait <= last || wait > spec.MaxDelay) {
+			t.Fatalf("take %d waits %v after %v, want more and at most %v", i, wait, last, spec.MaxDelay)
+		}
+		last = wait
+	}
+	if wait, ok := l.take("client"); ok {
+		t.Fatalf("take beyond max-delay was allowed with a wait of %v", wait)
+	}
+	if wait, ok := l.take("other client"); !ok || wait != 0 {
+		t.Fatalf("another client waits %v (%v)", wait, ok)
+	}
+}
+
+func TestLimiterReject(t *testing.T) {
+	spec, err := parseLimiterSpec("reject,capacity=2,refill=1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLimiter("test", spec)
+	for i := 0; i < 2; i++ {
+		if wait, ok := l.take("client"); !ok || wait != 0 {
+			t.Fatalf("take %d waits %v (%v)", i, wait, ok)
+		}
+	}
+	if wait, ok := l.take("client"); ok || wait <= 0 || wait > time.Hour {
+		t.Fatalf("take of an empty bucket: wait %v, allowed %v", wait, ok)
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unlockTokenTTL is how long an unlock token is valid unless the admin asks
+// for another ttl
+const unlockTokenTTL = 24 * time.Hour
+
+// errLocked is returned when an account is locked after failed logins.
+var errLocked = errors.New("account is locked")
+
+// errUnlockUsed is returned for an unlock token whose lock was cleared.
+var errUnlockUsed = errors.New("unlock token was already used")
+
+// lockoutSpec configures the lockout after failed logins. Its string form
+// is
+//
+//	after=3,delay=15m,max-delay=24h,hard=10
+//
+// From the after-th failure since the last successful login on, every
+// failure locks the account for delay, doubled with each further failure
+// up to max-delay. The hard-th failure locks it until an admin unlocks it
+// or the user presents an unlock token; hard=0 never locks for good.
+type lockoutSpec struct {
+	After    int
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Hard     int
+}
+
+// parseLockoutSpec parses a lockout spec. An empty spec or "none" disables
+// the lockout and returns nil.
+func parseLockoutSpec(spec string) (*lockoutSpec, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	l := &lockoutSpec{MaxDelay: 24 * time.Hour}
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed lockout parameter %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "after":
+			l.After, err = strconv.Atoi(kv[1])
+		case "delay":
+			l.Delay, err = time.ParseDuration(kv[1])
+		case "max-delay":
+			l.MaxDelay, err = time.ParseDuration(kv[1])
+		case "hard":
+			l.Hard, err = strconv.Atoi(kv[1])
+		default:
+			return nil, fmt.Errorf("unknown lockout parameter %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("malformed lockout parameter %q", field)
+		}
+	}
+	if l.After < 1 || l.Delay <= 0 || l.MaxDelay < l.Delay {
+		return nil, errors.New("a lockout needs after >= 1, a positive delay and max-delay >= delay")
+	}
+	if l.Hard != 0 && l.Hard < l.After {
+		return nil, errors.New("hard must be 0 or at least after")
+	}
+	return l, nil
+}
+
+// fail counts one more failure and locks the bucket accordingly. Every
+// attempt counts as a failure until a successful login refunds it.
+func (l *lockoutSpec) fail(b bucket, now time.Time) bucket {
+	b.Failures++
+	if l.Hard > 0 && b.Failures >= l.Hard {
+		locked := now
+		b.Locked, b.Until = &locked, nil
+		return b
+	}
+	if b.Failures >= l.After {
+		delay := l.Delay
+		for i := l.After; i < b.Failures && delay < l.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > l.MaxDelay {
+			delay = l.MaxDelay
+		}
+		until := now.Add(delay)
+		b.Until = &until
+	}
+	return b
+}
+
+// locked tells whether the bucket is locked at now.
+func (b bucket) locked(now time.Time) bool {
+	return b.Locked != nil || b.Until != nil && now.Before(*b.Until)
+}
+
+// lockedResponse is the body of a login refused by the lockout or an
+// empty bucket. LockedUntil is unset for a hard lock.
+type lockedResponse struct {
+	Error       string     `json:"error"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+	Unlock      string     `json:"unlock,omitempty"`
+}
+
+// writeLocked tells the client until when the account of b is locked.
+func writeLocked(w http.ResponseWriter, b bucket, limits bucketLimits, now time.Time) {
+	response := lockedResponse{Error: "account locked"}
+	if b.Locked != nil {
+		response.Unlock = "admin or unlock token"
+	} else {
+		var until time.Time
+		if b.Until != nil {
+			until = *b.Until
+		}
+		if b = b.refill(limits, now); b.Tokens == 0 && b.Refilled.Add(limits.Refill).After(until) {
+			until = b.Refilled.Add(limits.Refill)
+		}
+		until = until.UTC().Truncate(time.Second).Add(time.Second)
+		response.LockedUntil = &until
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(until.Sub(now).Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusLocked)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// unlockHandler lets an admin clear the lock of the account given by the
+// username query parameter; the account gets a full bucket.
+func unlockHandler(database UserStore, attempts *attemptLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		username := r.URL.Query().Get("username")
+		saltKey, ok := lookupSaltKey(w, database, username)
+		if !ok {
+			return
+		}
+		if err := attempts.unlock(saltKey, nil); err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to unlock the account", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🔓 Admin unlocked %s\n", username)
+		status, _ := attempts.status(saltKey)
+		status.Username = username
+		writeJSON(w, status)
+	}
+}
+
+// unlockClaims are signed into an unlock token. Locked is the time of the
+// hard lock the token clears, so it works only once.
+type unlockClaims struct {
+	Username string    `json:"username"`
+	Locked   time.Time `json:"locked"`
+	Expiry   time.Time `json:"exp"`
+}
+
+// unlockTokenResponse is the answer of the admin unlock token request.
+type unlockTokenResponse struct {
+	Username string    `json:"username"`
+	Token    string    `json:"token"`
+	Expiry   time.Time `json:"expires"`
+}
+
+// unlockKey derives the key of the unlock tokens from an hmac key, so they
+// are signed inside the enclave and rotate with the key ring.
+func unlockKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("passhield unlock token v1"))
+	return mac.Sum(nil)
+}
+
+func signUnlock(kid string, key []byte, payload string) string {
+	mac := hmac.New(sha256.New, unlockKey(key))
+	mac.Write([]byte(kid + "." + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newUnlockToken returns "<kid>.<claims>.<mac>", both base64url encoded.
+func newUnlockToken(keys *keyRing, claims unlockClaims) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	kid, key := keys.currentKey()
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return kid + "." + payload + "." + signUnlock(kid, key, payload), nil
+}
+
+// parseUnlockToken checks the mac and expiry of an unlock token.
+func parseUnlockToken(keys *keyRing, token string, now time.Time) (unlockClaims, error) {
+	var claims unlockClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed unlock token")
+	}
+	key, err := keys.key(parts[0])
+	if err != nil {
+		return claims, err
+	}
+	if !hmac.Equal([]byte(signUnlock(parts[0], key, parts[1])), []byte(parts[2])) {
+		return claims, errors.New("unlock token has a wrong mac")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, err
+	}
+	if err := json.Unmarshal(data, &claims); err != nil {
+		return claims, err
+	}
+	if now.After(claims.Expiry) {
+		return claims, errors.New("unlock token expired")
+	}
+	return claims, nil
+}
+
+// unlockTokenHandler lets an admin issue an unlock token for the hard
+// locked account given by the username query parameter, e.g. for support
+// to send to the user. ttl overrides how long it is valid.
+func unlockTokenHandler(keys *keyRing, database UserStore, attempts *attemptLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		ttl := unlockTokenTTL
+		if s := r.URL.Query().Get("ttl"); s != "" {
+			var err error
+			if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+				http.Error(w, "ttl must be a positive duration", http.StatusBadRequest)
+				return
+			}
+		}
+		username := r.URL.Query().Get("username")
+		saltKey, ok := lookupSaltKey(w, database, username)
+		if !ok {
+			return
+		}
+		status, _ := attempts.status(saltKey)
+		if status.Locked == nil {
+			http.Error(w, "Account is not hard locked", http.StatusConflict)
+			return
+		}
+		claims := unlockClaims{Username: username, Locked: *status.Locked, Expiry: time.Now().Add(ttl).UTC().Truncate(time.Second)}
+		token, err := newUnlockToken(keys, claims)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to create the unlock token", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, unlockTokenResponse{Username: username, Token: token, Expiry: claims.Expiry})
+	}
+}
+
+// userUnlockHandler clears the hard lock named by the token query
+// parameter.
+func userUnlockHandler(keys *keyRing, database UserStore, attempts *attemptLog) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Only GET requests are allowed", http.StatusBadRequest)
+			return
+		}
+		claims, err := parseUnlockToken(keys, r.URL.Query().Get("token"), time.Now())
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Invalid or expired unlock token", http.StatusForbidden)
+			return
+		}
+		saltKey, err := userSaltKey(database, claims.Username)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Invalid or expired unlock token", http.StatusForbidden)
+			return
+		}
+		err = attempts.unlock(saltKey, &claims.Locked)
+		if err == errUnlockUsed {
+			http.Error(w, "Unlock token was already used", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to unlock the account", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🔓 %s unlocked with an unlock token\n", claims.Username)
+		w.Write([]byte("Account unlocked"))
+	}
+}
+
+// lookupSaltKey returns the salt key of username, or writes the error
+// response and returns false.
+func lookupSaltKey(w http.ResponseWriter, database UserStore, username string) (string, bool) {
+	saltKey, err := userSaltKey(database, username)
+	if err == ErrNotFound {
+		http.Error(w, "Unknown username", http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		fmt.Println(err)
+		http.Error(w, "Failed to read the user", http.StatusInternalServerError)
+		return "", false
+	}
+	return saltKey, true
+}
+
+// userSaltKey returns the bucket key of username, taken from its record.
+func userSaltKey(database UserStore, username string) (string, error) {
+	salt, stored, err := database.GetSaltAndHmac(username)
+	if err != nil {
+		return "", err
+	}
+	record, err := parseRecord(stored, salt)
+	if err != nil {
+		return "", err
+	}
+	return bucketKey(record), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestLockoutExpiryAndUnlock logs in through the handler: a temporary lock
+// refuses even the right password until it expires, and a hard lock stays
+// until an admin unlocks the account.
+func TestLockoutExpiryAndUnlock(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	s := newTestServer(t, 10, "after=2,delay=100ms,max-delay=200ms,hard=4")
+	s.get(s.register, "alice", "password")
+	locked := func(pwd string) lockedResponse {
+		t.Helper()
+		w := s.get(s.login, "alice", pwd)
+		if w.Code != http.StatusLocked {
+			t.Fatalf("login with %q while locked: %d %s", pwd, w.Code, w.Body.String())
+		}
+		var response lockedResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	loggedIn := func() {
+		t.Helper()
+		if w := s.get(s.login, "alice", "password"); w.Code != http.StatusOK || len(w.Body.String()) != sessionTokenSize {
+			t.Fatalf("login with the right password: %d %s", w.Code, w.Body.String())
+		}
+	}
+	wrong := func() {
+		t.Helper()
+		if w := s.get(s.login, "alice", "wrong"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), loginFailed) {
+			t.Fatalf("login with a wrong password: %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	// the second failure locks for delay
+	wrong()
+	wrong()
+	if response := locked("password"); response.LockedUntil == nil || response.Unlock != "" {
+		t.Errorf("temporary lock answered %+v", response)
+	}
+	time.Sleep(delay + 20*time.Millisecond)
+	loggedIn()
+
+	// the fourth failure since that login locks for good
+	for i := 0; i < 4; i++ {
+		wrong()
+		// outlast the temporary locks of the third failure on
+		time.Sleep(2*delay + 20*time.Millisecond)
+	}
+	if response := locked("password"); response.LockedUntil != nil || response.Unlock == "" {
+		t.Errorf("hard lock answered %+v", response)
+	}
+
+	unlock := unlockHandler(s.database, s.attempts)
+	w := httptest.NewRecorder()
+	unlock(w, httptest.NewRequest("POST", "/admin/users/unlock?username=bob", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unlocking an unknown user: %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	unlock(w, httptest.NewRequest("POST", "/admin/users/unlock?username=alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unlock: %d %s", w.Code, w.Body.String())
+	}
+	loggedIn()
+}
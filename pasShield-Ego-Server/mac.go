@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"sort"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// macAlgorithms maps the alg parameter of a record to its keyed MAC. Names
+// are stored in records, so an algorithm must never be removed or changed
+// once released.
+var macAlgorithms = map[string]func(key []byte) (hash.Hash, error){
+	algHmacSHA256: func(key []byte) (hash.Hash, error) {
+		return hmac.New(sha256.New, key), nil
+	},
+	"hmac-sha512": func(key []byte) (hash.Hash, error) {
+		return hmac.New(sha512.New, key), nil
+	},
+	"hmac-sha3-256": func(key []byte) (hash.Hash, error) {
+		return hmac.New(sha3.New256, key), nil
+	},
+	"hmac-sha3-512": func(key []byte) (hash.Hash, error) {
+		return hmac.New(sha3.New512, key), nil
+	},
+	"blake2b-512": func(key []byte) (hash.Hash, error) {
+		return blake2b.New512(blake2bKey(key))
+	},
+}
+
+// blake2bKey fits a hmac key into the 64 byte key of keyed BLAKE2b.
+func blake2bKey(key []byte) []byte {
+	if len(key) <= blake2b.Size {
+		return key
+	}
+	sum := sha512.Sum512(key)
+	return sum[:]
+}
+
+// macAlgorithmNames returns the registered algorithm names, sorted.
+func macAlgorithmNames() []string {
+	names := make([]string, 0, len(macAlgorithms))
+	for name := range macAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// computeMAC computes the keyed MAC alg over input and returns it as hex,
+// like genHmac does for hmac-sha256.
+func computeMAC(alg string, input []byte, key []byte) (string, error) {
+	newMAC, ok := macAlgorithms[alg]
+	if !ok {
+		return "", errors.New("unknown mac algorithm: " + alg)
+	}
+	mac, err := newMAC(key)
+	if err != nil {
+		return "", err
+	}
+	mac.Write(input)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// migration is one versioned step of the database schema. Released
+// migrations must never be edited; change the schema by appending a new
+// migration with the next version number.
+type migration struct {
+	version     int
+	description string
+	// statements are run in one transaction. "{{blob}}" is replaced by the
+	// binary column type of the database (BLOB or BYTEA).
+	statements []string
+	// postgres are run after statements on postgres only, for changes that
+	// SQLite does not need or support (e.g. ALTER COLUMN).
+	postgres []string
+}
+
+// migrations are applied in order on startup.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "initial tables",
+		// IF NOT EXISTS so that databases created before schema_version
+		// existed are adopted as version 1.
+		statements: []string{
+			//Table for username,Hmac and salt.
+			"CREATE TABLE IF NOT EXISTS Hmac (username varchar(50) PRIMARY KEY, hmac varchar(128), salt {{blob}})",
+			//Table for Hmac key
+			"CREATE TABLE IF NOT EXISTS Sealed (Hmackey {{blob}} PRIMARY KEY)",
+			//Table for salt_with_attempt
+			"CREATE TABLE IF NOT EXISTS salt_with_attempt (data {{blob}} PRIMARY KEY)",
+			//Table for attemp resetTime
+			"CREATE TABLE IF NOT EXISTS resetTime (time {{blob}} PRIMARY KEY)",
+			//Table for Token key
+			"CREATE TABLE IF NOT EXISTS Token (username varchar(50) PRIMARY KEY, Token varchar(256))",
+		},
+	},
+	{
+		version:     2,
+		description: "versioned password records",
+		// SQLite does not enforce varchar lengths
+		postgres: []string{
+			"ALTER TABLE Hmac ALTER COLUMN hmac TYPE TEXT",
+		},
+	},
+	{
+		version:     3,
+		description: "attempt log",
+		statements: []string{
+			"CREATE TABLE attempt_log (seq BIGINT PRIMARY KEY, entry {{blob}})",
+		},
+	},
+	{
+		version:     4,
+		description: "token buckets replace the reset time",
+		statements: []string{
+			"DROP TABLE resetTime",
+		},
+	},
+	{
+		version:     5,
+		description: "attempt partitions",
+		statements: []string{
+			"CREATE TABLE attempt_partition (id INTEGER PRIMARY KEY, data {{blob}})",
+		},
+	},
+	{
+		version:     6,
+		description: "sessions replace the login token",
+		// the old tokens never expire, so they are dropped and every user
+		// logs in again
+		statements: []string{
+			"DROP TABLE Token",
+			"CREATE TABLE session (token varchar(64) PRIMARY KEY, username varchar(50) NOT NULL, created BIGINT NOT NULL, last_seen BIGINT NOT NULL, expires BIGINT NOT NULL)",
+			"CREATE INDEX session_username ON session (username)",
+			"CREATE INDEX session_expires ON session (expires)",
+		},
+	},
+	{
+		version:     7,
+		description: "attempt index without a key on its data",
+		// the sealed index outgrew what a postgres btree key can hold, so
+		// it moves to a single row with id 1
+		statements: []string{
+			"CREATE TABLE attempt_index (id INTEGER PRIMARY KEY, data {{blob}})",
+			"INSERT INTO attempt_index (id, data) SELECT 1, data FROM salt_with_attempt LIMIT 1",
+			"DROP TABLE salt_with_attempt",
+		},
+	},
+}
+
+// schemaVersion returns the version recorded in schema_version, or 0 for
+// a database that was never migrated.
+func schemaVersion(database *sql.DB) (int, error) {
+	if _, err := database.Exec("CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)"); err != nil {
+		return 0, err
+	}
+	var version int
+	err := database.QueryRow("SELECT version FROM schema_version").Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// migrate brings the database schema up to the latest version. It refuses
+// to run against a schema newer than this server knows, as that database
+// was written by a newer release.
+func migrate(database *sql.DB, driver string) error {
+	current, err := schemaVersion(database)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the latest known version %d", current, latest)
+	}
+
+	blob := "BLOB"
+	if driver == "postgres" {
+		blob = "BYTEA"
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(database, m, driver, blob); err != nil {
+			return fmt.Errorf("migration %d (%s) failed: %v", m.version, m.description, err)
+		}
+		fmt.Printf("🆗 Migrated database schema to version %d: %s.\n", m.version, m.description)
+	}
+	return nil
+}
+
+func applyMigration(database *sql.DB, m migration, driver string, blob string) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := m.statements
+	if driver == "postgres" {
+		statements = append(statements, m.postgres...)
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(strings.Replace(statement, "{{blob}}", blob, -1)); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM schema_version"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%d)", m.version)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMigrateFromEachVersion fills a database of every earlier schema
+// version, including one from before schema_version existed, and checks
+// that it is migrated to the latest version with its data.
+func TestMigrateFromEachVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	latest := migrations[len(migrations)-1].version
+	salt, record, sealedKey, index := []byte("salt of alice"), "0123abcd", []byte("sealed key ring"), []byte("sealed attempt index")
+
+	for from := 0; from <= latest; from++ {
+		t.Run(fmt.Sprintf("version %d", from), func(t *testing.T) {
+			file := filepath.Join(dir, fmt.Sprintf("v%d.db", from))
+			database, err := sql.Open("sqlite3", file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if from == 0 {
+				// the tables as the first release created them
+				for _, statement := range migrations[0].statements {
+					if _, err := database.Exec(strings.Replace(statement, "{{blob}}", "BLOB", -1)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			} else {
+				if _, err := schemaVersion(database); err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range migrations[:from] {
+					if err := applyMigration(database, m, "sqlite3", "BLOB"); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			fill := []string{"INSERT INTO Hmac (username, hmac, salt) VALUES (?, ?, ?)", "INSERT INTO Sealed (Hmackey) VALUES (?)"}
+			args := [][]interface{}{{"alice", record, salt}, {sealedKey}}
+			if from < 7 {
+				fill, args = append(fill, "INSERT INTO salt_with_attempt (data) VALUES (?)"), append(args, []interface{}{index})
+			} else {
+				fill, args = append(fill, "INSERT INTO attempt_index (id, data) VALUES (1, ?)"), append(args, []interface{}{index})
+			}
+			if from < 6 {
+				fill, args = append(fill, "INSERT INTO Token (username, Token) VALUES (?, ?)"), append(args, []interface{}{"alice", "old token"})
+			}
+			for i, statement := range fill {
+				if _, err := database.Exec(statement, args[i]...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			database.Close()
+
+			// migrating twice leaves the database as it is
+			for i := 0; i < 2; i++ {
+				s, err := newSQLStore("sqlite3", file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if version, err := schemaVersion(s.db); err != nil || version != latest {
+					t.Errorf("schema version %d (%v), want %d", version, err, latest)
+				}
+				gotSalt, gotRecord, err := s.GetSaltAndHmac("alice")
+				if err != nil || !bytes.Equal(gotSalt, salt) || gotRecord != record {
+					t.Errorf("user row %q %q (%v)", gotSalt, gotRecord, err)
+				}
+				if got, err := s.GetSealedHmacKey(); err != nil || !bytes.Equal(got, sealedKey) {
+					t.Errorf("sealed key ring %q (%v)", got, err)
+				}
+				if got, err := s.GetSealedAttempts(); err != nil || !bytes.Equal(got, index) {
+					t.Errorf("attempt index %q (%v)", got, err)
+				}
+				now := time.Now()
+				if err := s.AddSession(fmt.Sprintf("hash %d", i), session{Username: "alice", Created: now, LastSeen: now, Expires: now.Add(time.Hour)}); err != nil {
+					t.Errorf("session table: %v", err)
+				}
+				s.Close()
+			}
+		})
+	}
+
+	// a database of a newer release is refused
+	file := filepath.Join(dir, fmt.Sprintf("v%d.db", latest))
+	database, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := database.Exec("UPDATE schema_version SET version = ?", latest+1); err != nil {
+		t.Fatal(err)
+	}
+	database.Close()
+	if s, err := newSQLStore("sqlite3", file); err == nil {
+		s.Close()
+		t.Error("a newer schema version is accepted")
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	"golang.org/x/text/secure/precis"
+	"golang.org/x/text/unicode/norm"
+)
+
+// errInvalidPassword is returned for passwords the normalization profile
+// does not allow, e.g. control characters under opaque.
+var errInvalidPassword = errors.New("password contains characters that are not allowed")
+
+// normalizations maps the norm parameter of a record to the Unicode
+// normalization applied to the password before hashing, so that the same
+// password typed on different systems gives the same bytes. Records
+// without the parameter use "none", the raw bytes as received.
+var normalizations = map[string]func(string) (string, error){
+	"none": func(pwd string) (string, error) { return pwd, nil },
+	"nfc": func(pwd string) (string, error) {
+		return norm.NFC.String(pwd), nil
+	},
+	"nfkc": func(pwd string) (string, error) {
+		return norm.NFKC.String(pwd), nil
+	},
+	// RFC 8265 OpaqueString: maps non-ASCII spaces to U+0020, applies NFC
+	// and rejects control and other disallowed characters
+	"opaque": func(pwd string) (string, error) {
+		return precis.OpaqueString.String(pwd)
+	},
+}
+
+// normalizationNames returns the registered profile names, sorted.
+func normalizationNames() []string {
+	names := make([]string, 0, len(normalizations))
+	for name := range normalizations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// normalizePassword applies the named profile to pwd.
+func normalizePassword(profile string, pwd string) (string, error) {
+	normalize, ok := normalizations[profile]
+	if !ok {
+		return "", errors.New("unknown normalization: " + profile)
+	}
+	normalized, err := normalize(pwd)
+	if err != nil {
+		return "", errInvalidPassword
+	}
+	return normalized, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// phantomPrefix marks the attempt buckets of usernames that do not exist
+const phantomPrefix = "phantom:"
+
+// phantomUser returns the bucket key and the record an unknown username
+// is checked against, so a probe for it takes the path of a wrong
+// password: the same bucket, lockout and mac work, and the same answer.
+// Both are derived from the username under the current hmac key, so
+// repeated probes see the same bucket. The record follows the policy like
+// a new registration, with a mac no password matches.
+func phantomUser(username string, saltSize int, keys *keyRing, policy recordPolicy) (string, passwordRecord, error) {
+	kid, hmacKey := keys.currentKey()
+	derive := func(label string, counter uint32) []byte {
+		mac := hmac.New(sha512.New, hmacKey)
+		mac.Write([]byte("passhield phantom v1"))
+		mac.Write(encodeFields([]byte(label), []byte(username)))
+		binary.Write(mac, binary.BigEndian, counter)
+		return mac.Sum(nil)
+	}
+	var salt []byte
+	for i := uint32(0); len(salt) < saltSize; i++ {
+		salt = append(salt, derive("salt", i)...)
+	}
+	record := passwordRecord{
+		Version: recordVersion,
+		Alg:     policy.Alg,
+		KeyID:   kid,
+		PreHash: policy.PreHash,
+		Norm:    policy.Norm,
+		Salt:    salt[:saltSize],
+	}
+	var err error
+	if record.MAC, err = computeMAC(record.Alg, derive("mac", 0), hmacKey); err != nil {
+		return "", passwordRecord{}, err
+	}
+	return phantomPrefix + hex.EncodeToString(derive("bucket", 0)[:16]), record, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestPhantomResponses checks that an unknown username gets the answers of
+// an existing one with a wrong password, up to the lock, and that its
+// guesses are counted in a bucket like real ones.
+func TestPhantomResponses(t *testing.T) {
+	const capacity = 2
+	s := newTestServer(t, capacity, "after=5,delay=1m")
+	first := s.get(s.register, "alice", "password")
+	if again := s.get(s.register, "alice", "other"); again.Code != first.Code || again.Body.String() != first.Body.String() {
+		t.Errorf("registering an existing username answers %d %s", again.Code, again.Body.String())
+	}
+
+	same := func(known *httptest.ResponseRecorder, phantom *httptest.ResponseRecorder) {
+		t.Helper()
+		if known.Code != phantom.Code {
+			t.Errorf("status %d for alice, %d for the unknown user", known.Code, phantom.Code)
+		}
+		for _, header := range []string{"Content-Type", "Retry-After"} {
+			if (known.Header().Get(header) == "") != (phantom.Header().Get(header) == "") {
+				t.Errorf("%s %q for alice, %q for the unknown user", header, known.Header().Get(header), phantom.Header().Get(header))
+			}
+		}
+		if known.Code != http.StatusLocked {
+			if known.Body.String() != phantom.Body.String() {
+				t.Errorf("body %q for alice, %q for the unknown user", known.Body.String(), phantom.Body.String())
+			}
+			return
+		}
+		// both are locked until their buckets refill, which may fall in
+		// different seconds
+		var a, b lockedResponse
+		if err := json.Unmarshal(known.Body.Bytes(), &a); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal(phantom.Body.Bytes(), &b); err != nil {
+			t.Fatal(err)
+		}
+		if a.Error != b.Error || a.Unlock != b.Unlock || (a.LockedUntil == nil) != (b.LockedUntil == nil) {
+			t.Errorf("locked answer %+v for alice, %+v for the unknown user", a, b)
+		}
+	}
+	for i := 0; i <= capacity; i++ {
+		same(s.get(s.login, "alice", "wrong"), s.get(s.login, "mallory", "wrong"))
+	}
+
+	// the probes took the attempts of a phantom bucket like alice's
+	phantomKey, _, err := phantomUser("mallory", defaultConfig().SaltSize, s.keys, s.policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aliceKey, err := userSaltKey(s.database, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	phantom, err := s.attempts.status(phantomKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	known, err := s.attempts.status(aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if phantom.Tokens != 0 || phantom.Tokens != known.Tokens || phantom.Failures != known.Failures {
+		t.Errorf("phantom bucket has %d attempts and %d failures, alice's %d and %d", phantom.Tokens, phantom.Failures, known.Tokens, known.Failures)
+	}
+}
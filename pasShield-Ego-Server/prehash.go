@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// preHashLength is the output length of the memory-hard pre-hash in bytes
+const preHashLength = 32
+
+// upper bounds of the pre-hash parameters. A record's parameters come from
+// the host, so one login must neither exhaust the enclave heap (heapSize
+// 512 MB in enclave.json) nor keep a handler busy for minutes.
+const (
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 128 * 1024 // KiB
+	maxArgon2Threads = 16
+	maxScryptMemory  = 128 << 20 // bytes, 128*n*r
+	maxScryptP       = 16
+)
+
+// preHash is an optional memory-hard function applied to the password and
+// salt before the enclave hmac, so that a leaked hmac key alone does not
+// make offline guessing cheap. Its string form is used both in the config
+// and in the record's pre parameter:
+//
+//	argon2id,t=3,m=65536,p=1   (time, memory in KiB, threads)
+//	scrypt,n=32768,r=8,p=1
+type preHash struct {
+	Alg     string
+	Time    uint32 // argon2id
+	Memory  uint32 // argon2id, KiB
+	Threads uint8  // argon2id
+	N       int    // scrypt
+	R       int    // scrypt
+	P       int    // scrypt
+}
+
+// parsePreHash parses a pre-hash spec. An empty spec or "none" means no
+// pre-hash and returns nil.
+func parsePreHash(spec string) (*preHash, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+	fields := strings.Split(spec, ",")
+	params := make(map[string]int)
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("malformed pre-hash parameter %q", field)
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("pre-hash parameter %q must be a positive number", field)
+		}
+		params[kv[0]] = n
+	}
+
+	p := &preHash{Alg: fields[0]}
+	switch p.Alg {
+	case "argon2id":
+		if len(params) != 3 || params["t"] == 0 || params["m"] == 0 || params["p"] == 0 {
+			return nil, errors.New("argon2id needs t, m and p parameters")
+		}
+		if params["t"] > maxArgon2Time || params["m"] > maxArgon2Memory || params["p"] > maxArgon2Threads {
+			return nil, fmt.Errorf("argon2id allows at most t=%d, m=%d and p=%d", maxArgon2Time, maxArgon2Memory, maxArgon2Threads)
+		}
+		p.Time, p.Memory, p.Threads = uint32(params["t"]), uint32(params["m"]), uint8(params["p"])
+	case "scrypt":
+		if len(params) != 3 || params["n"] == 0 || params["r"] == 0 || params["p"] == 0 {
+			return nil, errors.New("scrypt needs n, r and p parameters")
+		}
+		if err := checkScrypt(params["n"], params["r"], params["p"]); err != nil {
+			return nil, err
+		}
+		p.N, p.R, p.P = params["n"], params["r"], params["p"]
+	default:
+		return nil, errors.New("unknown pre-hash: " + p.Alg)
+	}
+	return p, nil
+}
+
+// checkScrypt refuses scrypt parameters that are not valid or cost more
+// than the bounds above.
+func checkScrypt(n int, r int, p int) error {
+	if n&(n-1) != 0 {
+		return errors.New("scrypt n must be a power of two")
+	}
+	// n and r alone are bounded first so the product cannot overflow
+	if n > maxScryptMemory || r > maxScryptMemory || 128*int64(n)*int64(r) > maxScryptMemory || p > maxScryptP {
+		return fmt.Errorf("scrypt allows at most 128*n*r=%d bytes and p=%d", maxScryptMemory, maxScryptP)
+	}
+	return nil
+}
+
+func (p *preHash) String() string {
+	switch p.Alg {
+	case "argon2id":
+		return fmt.Sprintf("argon2id,t=%d,m=%d,p=%d", p.Time, p.Memory, p.Threads)
+	case "scrypt":
+		return fmt.Sprintf("scrypt,n=%d,r=%d,p=%d", p.N, p.R, p.P)
+	}
+	return p.Alg
+}
+
+// apply derives the hmac input from the password and salt.
+func (p *preHash) apply(password []byte, salt []byte) ([]byte, error) {
+	switch p.Alg {
+	case "argon2id":
+		return argon2.IDKey(password, salt, p.Time, p.Memory, p.Threads, preHashLength), nil
+	case "scrypt":
+		return scrypt.Key(password, salt, p.N, p.R, p.P, preHashLength)
+	}
+	return nil, errors.New("unknown pre-hash: " + p.Alg)
+}
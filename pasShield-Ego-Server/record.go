@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// recordPrefix starts every versioned password record
+const recordPrefix = "$psh$"
+
+// recordVersion is the version written for new registrations
+const recordVersion = 4
+
+// algHmacSHA256 is the MAC algorithm used since the first release and the
+// only one of version 0 and 1 records
+const algHmacSHA256 = "hmac-sha256"
+
+// passwordRecord is a stored password hash. Its string form is
+//
+//	$psh$v=4$alg=hmac-sha256$kid=1[$wrap=2,3]$<salt>$<mac>
+//
+// where salt is unpadded standard base64 and mac is hex. Records written
+// before the format existed are a bare hex mac with the salt in its own
+// column; they are parsed as version 0.
+//
+// Version 2 adds two optional parameters: the wrap chain, the key
+// generations whose hmac was applied in order on top of the mac computed
+// with kid (see wrapMAC), and pre, a memory-hard pre-hash (see preHash).
+// Its alg may be any algorithm of macAlgorithms; wrap layers use the same.
+//
+// Version 3 computes the innermost mac over an unambiguous encoding of
+// the password and salt instead of password || salt (see macInput), and
+// adds norm, the Unicode normalization of the password (see
+// normalizations), which is "none" if absent.
+//
+// Version 4 adds the username to the mac input, so a record copied to
+// another user's row does not verify, and legacy, the scheme of a hash
+// imported from another user table (see legacyHash).
+type passwordRecord struct {
+	Version int
+	Alg     string
+	KeyID   string
+	Wrap    []string
+	PreHash *preHash
+	Norm    string
+	Legacy  *legacyHash
+	Salt    []byte
+	MAC     string
+}
+
+// recordParams lists the parameters a record may have; records with any
+// other parameter are rejected rather than verified the wrong way.
+var recordParams = map[string]bool{"v": true, "alg": true, "kid": true, "wrap": true, "pre": true, "norm": true, "legacy": true}
+
+// recordPolicy is how new records are created, taken from the config.
+type recordPolicy struct {
+	Alg     string
+	PreHash *preHash
+	Norm    string
+}
+
+func newRecordPolicy(cfg Config) (recordPolicy, error) {
+	pre, err := parsePreHash(cfg.PreHash)
+	if err != nil {
+		return recordPolicy{}, err
+	}
+	if _, ok := macAlgorithms[cfg.MAC]; !ok {
+		return recordPolicy{}, errors.New("unknown mac algorithm: " + cfg.MAC)
+	}
+	if _, ok := normalizations[cfg.Normalization]; !ok {
+		return recordPolicy{}, errors.New("unknown normalization: " + cfg.Normalization)
+	}
+	return recordPolicy{Alg: cfg.MAC, PreHash: pre, Norm: cfg.Normalization}, nil
+}
+
+func (r passwordRecord) String() string {
+	fields := []string{
+		"v=" + strconv.Itoa(r.Version),
+		"alg=" + r.Alg,
+		"kid=" + r.KeyID,
+	}
+	if len(r.Wrap) > 0 {
+		fields = append(fields, "wrap="+strings.Join(r.Wrap, ","))
+	}
+	if r.PreHash != nil {
+		fields = append(fields, "pre="+r.PreHash.String())
+	}
+	if r.Norm != "" && r.Norm != "none" {
+		fields = append(fields, "norm="+r.Norm)
+	}
+	if r.Legacy != nil {
+		fields = append(fields, "legacy="+r.Legacy.String())
+	}
+	fields = append(fields, base64.RawStdEncoding.EncodeToString(r.Salt), r.MAC)
+	return recordPrefix + strings.Join(fields, "$")
+}
+
+// outerKeyID returns the key generation of the outermost hmac, which is
+// the key an attacker would need to test password guesses.
+func (r passwordRecord) outerKeyID() string {
+	if len(r.Wrap) > 0 {
+		return r.Wrap[len(r.Wrap)-1]
+	}
+	return r.KeyID
+}
+
+// keyIDs returns every key generation needed to verify the record.
+func (r passwordRecord) keyIDs() []string {
+	return append([]string{r.KeyID}, r.Wrap...)
+}
+
+// parseRecord parses the hmac column of the Hmac table. salt is the salt
+// column, which is only used for version 0 records.
+func parseRecord(stored string, salt []byte) (passwordRecord, error) {
+	if !strings.HasPrefix(stored, recordPrefix) {
+		// version 0: bare hex string from genHmac
+		if _, err := hex.DecodeString(stored); err != nil {
+			return passwordRecord{}, errors.New("record is neither versioned nor a hex hmac")
+		}
+		// written with the only key there was, now generation "1"
+		return passwordRecord{Version: 0, Alg: algHmacSHA256, KeyID: "1", Norm: "none", Salt: salt, MAC: stored}, nil
+	}
+
+	fields := strings.Split(strings.TrimPrefix(stored, recordPrefix), "$")
+	if len(fields) < 3 {
+		return passwordRecord{}, errors.New("record is truncated")
+	}
+	// all fields but the last two (salt and mac) are key=value parameters
+	params := make(map[string]string)
+	for _, field := range fields[:len(fields)-2] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return passwordRecord{}, fmt.Errorf("malformed record parameter %q", field)
+		}
+		if !recordParams[kv[0]] {
+			return passwordRecord{}, fmt.Errorf("unknown record parameter %q", kv[0])
+		}
+		params[kv[0]] = kv[1]
+	}
+
+	version, err := strconv.Atoi(params["v"])
+	if err != nil {
+		return passwordRecord{}, errors.New("record has no valid version")
+	}
+	if version < 1 || version > recordVersion {
+		return passwordRecord{}, fmt.Errorf("unsupported record version %d", version)
+	}
+	decodedSalt, err := base64.RawStdEncoding.DecodeString(fields[len(fields)-2])
+	if err != nil {
+		return passwordRecord{}, fmt.Errorf("record salt: %v", err)
+	}
+	var wrap []string
+	if chain, ok := params["wrap"]; ok {
+		if version < 2 {
+			return passwordRecord{}, fmt.Errorf("wrap chain in version %d record", version)
+		}
+		wrap = strings.Split(chain, ",")
+	}
+	var pre *preHash
+	if spec, ok := params["pre"]; ok {
+		if version < 2 {
+			return passwordRecord{}, fmt.Errorf("pre-hash in version %d record", version)
+		}
+		if pre, err = parsePreHash(spec); err != nil {
+			return passwordRecord{}, err
+		}
+	}
+	normalization := "none"
+	if profile, ok := params["norm"]; ok {
+		if version < 3 {
+			return passwordRecord{}, fmt.Errorf("normalization in version %d record", version)
+		}
+		if _, ok := normalizations[profile]; !ok {
+			return passwordRecord{}, errors.New("unknown normalization: " + profile)
+		}
+		normalization = profile
+	}
+	var legacy *legacyHash
+	if spec, ok := params["legacy"]; ok {
+		if version < 4 {
+			return passwordRecord{}, fmt.Errorf("legacy scheme in version %d record", version)
+		}
+		if legacy, err = parseLegacySpec(spec); err != nil {
+			return passwordRecord{}, err
+		}
+	}
+	if version < 2 && params["alg"] != algHmacSHA256 {
+		return passwordRecord{}, fmt.Errorf("algorithm %q in version %d record", params["alg"], version)
+	}
+	return passwordRecord{
+		Version: version,
+		Alg:     params["alg"],
+		KeyID:   params["kid"],
+		Wrap:    wrap,
+		PreHash: pre,
+		Norm:    normalization,
+		Legacy:  legacy,
+		Salt:    decodedSalt,
+		MAC:     fields[len(fields)-1],
+	}, nil
+}
+
+// createRecord computes a record of the current version for pwd under the
+// current hmac key, as the policy prescribes.
+func createRecord(username string, pwd string, salt []byte, keys *keyRing, policy recordPolicy) (passwordRecord, error) {
+	kid, hmacKey := keys.currentKey()
+	record := passwordRecord{
+		Version: recordVersion,
+		Alg:     policy.Alg,
+		KeyID:   kid,
+		PreHash: policy.PreHash,
+		Norm:    policy.Norm,
+		Salt:    salt,
+	}
+	input, err := macInput(username, pwd, record)
+	if err != nil {
+		return passwordRecord{}, err
+	}
+	if record.MAC, err = computeMAC(record.Alg, input, hmacKey); err != nil {
+		return passwordRecord{}, err
+	}
+	return record, nil
+}
+
+// createLegacyRecord computes a record for an imported legacy hash, whose
+// mac covers the legacy digest in place of the password.
+func createLegacyRecord(username string, legacy *legacyHash, digest string, salt []byte, keys *keyRing, policy recordPolicy) (passwordRecord, error) {
+	kid, hmacKey := keys.currentKey()
+	record := passwordRecord{
+		Version: recordVersion,
+		Alg:     policy.Alg,
+		KeyID:   kid,
+		Norm:    "none",
+		Legacy:  legacy,
+		Salt:    salt,
+	}
+	var err error
+	if record.MAC, err = computeMAC(record.Alg, encodeInput(username, []byte(digest), record), hmacKey); err != nil {
+		return passwordRecord{}, err
+	}
+	return record, nil
+}
+
+// macInput is what the innermost hmac of the record is computed over. Up
+// to version 2 it is password || salt, or the pre-hash output. Version 3
+// and later encode the password, the pre-hash output or the legacy digest
+// with encodeInput. The password is normalized first.
+func macInput(username string, pwd string, record passwordRecord) ([]byte, error) {
+	pwd, err := normalizePassword(record.Norm, pwd)
+	if err != nil {
+		return nil, err
+	}
+	password := []byte(pwd)
+	switch {
+	case record.Legacy != nil:
+		if password, err = record.Legacy.apply(password); err != nil {
+			return nil, err
+		}
+	case record.PreHash != nil:
+		hashed, err := record.PreHash.apply(password, record.Salt)
+		if err != nil {
+			return nil, err
+		}
+		if record.Version < 3 {
+			return hashed, nil
+		}
+		password = hashed
+	case record.Version < 3:
+		return salting(pwd, record.Salt), nil
+	}
+	return encodeInput(username, password, record), nil
+}
+
+// encodeInput encodes a version 3 mac input as the label, password and
+// salt, and a version 4 one as the label, username, password and salt.
+func encodeInput(username string, password []byte, record passwordRecord) []byte {
+	if record.Version < 4 {
+		return encodeFields(macLabel(3), password, record.Salt)
+	}
+	return encodeFields(macLabel(record.Version), []byte(username), password, record.Salt)
+}
+
+// macLabel is the domain-separation label of the mac input of a version.
+func macLabel(version int) []byte {
+	return []byte(fmt.Sprintf("passhield password mac v%d", version))
+}
+
+// encodeFields concatenates the fields, each prefixed with its length as a
+// 4 byte big-endian number, so that different field lists never encode to
+// the same bytes.
+func encodeFields(fields ...[]byte) []byte {
+	size := 0
+	for _, field := range fields {
+		size += 4 + len(field)
+	}
+	encoded := make([]byte, 0, size)
+	for _, field := range fields {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		encoded = append(encoded, length[:]...)
+		encoded = append(encoded, field...)
+	}
+	return encoded
+}
+
+// verifyPassword recomputes the mac of pwd for the user who owns the row
+// the way the record was created and compares it in constant time.
+func verifyPassword(username string, pwd string, record passwordRecord, keys *keyRing) (bool, error) {
+	hmacKey, err := keys.key(record.KeyID)
+	if err != nil {
+		return false, err
+	}
+	switch record.Version {
+	case 0, 1:
+		if record.Alg != algHmacSHA256 {
+			return false, fmt.Errorf("unsupported algorithm %q in version %d record", record.Alg, record.Version)
+		}
+		newHmac := genHmac(salting(pwd, record.Salt), hmacKey)
+		return compareHMACs(record.MAC, newHmac), nil
+	case 2, 3, 4:
+		input, err := macInput(username, pwd, record)
+		if err != nil {
+			return false, err
+		}
+		newHmac, err := computeMAC(record.Alg, input, hmacKey)
+		if err != nil {
+			return false, err
+		}
+		// evaluate the wrap chain from the inside out
+		for _, kid := range record.Wrap {
+			wrapKey, err := keys.key(kid)
+			if err != nil {
+				return false, err
+			}
+			if newHmac, err = wrapMAC(record.Alg, newHmac, wrapKey); err != nil {
+				return false, err
+			}
+		}
+		return compareHMACs(record.MAC, newHmac), nil
+	default:
+		return false, fmt.Errorf("unsupported record version %d", record.Version)
+	}
+}
+
+// upToDate reports whether the record is of the current version, under the
+// plain current key and follows the policy.
+func (r passwordRecord) upToDate(kid string, policy recordPolicy) bool {
+	if r.Version != recordVersion || r.KeyID != kid || len(r.Wrap) > 0 || r.Alg != policy.Alg || r.Norm != policy.Norm || r.Legacy != nil {
+		return false
+	}
+	if (r.PreHash == nil) != (policy.PreHash == nil) {
+		return false
+	}
+	return r.PreHash == nil || r.PreHash.String() == policy.PreHash.String()
+}
+
+// rekeyRecord rewrites the record of a user who just logged in with pwd
+// under the current hmac key and policy. Records that are up to date are
+// left alone. stored is the record as read from the database; if it was
+// changed in the meantime the update is skipped.
+func rekeyRecord(username string, stored string, pwd string, record passwordRecord, keys *keyRing, policy recordPolicy, database UserStore) error {
+	kid, _ := keys.currentKey()
+	if record.upToDate(kid, policy) {
+		return nil
+	}
+	rekeyed, err := createRecord(username, pwd, record.Salt, keys, policy)
+	if err != nil {
+		return err
+	}
+	if err := database.UpdateHmac(username, stored, rekeyed.String()); err != nil && err != ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// wrapMAC puts another layer around a hex mac: MAC(key, mac) with the
+// record's algorithm.
+func wrapMAC(alg string, mac string, key []byte) (string, error) {
+	inner, err := hex.DecodeString(mac)
+	if err != nil {
+		return "", err
+	}
+	return computeMAC(alg, inner, key)
+}
+
+// wrapRecord wraps the mac of a record with the given key generation
+// without knowing the password. Version 0 and 1 records become version 2,
+// which has the same mac input and supports wrapping. Like any record
+// before version 4 the result does not cover the username; rekeyRecord
+// moves it to the current version when its user logs in.
+func wrapRecord(record passwordRecord, kid string, key []byte) (passwordRecord, error) {
+	mac, err := wrapMAC(record.Alg, record.MAC, key)
+	if err != nil {
+		return passwordRecord{}, err
+	}
+	if record.Version < 2 {
+		record.Version = 2
+	}
+	record.Wrap = append(append([]string(nil), record.Wrap...), kid)
+	record.MAC = mac
+	return record, nil
+}
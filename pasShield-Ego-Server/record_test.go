@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// the test vectors published in the README; they must never change for
+// the record versions that are already released
+var (
+	vectorKey  = []byte("pasShield test key")
+	vectorSalt = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+)
+
+var macInputVectors = []struct {
+	version  int
+	username string
+	password string
+	input    string
+	sha256   string
+	sha512   string
+}{
+	{4, "alice", "password",
+		"00000019706173736869656c642070617373776f7264206d616320763400000005616c6963650000000870617373776f726400000010000102030405060708090a0b0c0d0e0f",
+		"2b5739d69b9db21e7cf84773a0cd958faa191c6b1384ac79bacbc25049664c7f",
+		"c66198e827fe108f2c1f49cc418bae2bb33e08201e92ee2e06f48659aec21dd3a265bd8f19dbcdfcff093a3663c4be57c0eca575f46641af73ea9df71f333400"},
+	{4, "bob", "password",
+		"00000019706173736869656c642070617373776f7264206d616320763400000003626f620000000870617373776f726400000010000102030405060708090a0b0c0d0e0f",
+		"419d34008ed0f5e3e06c7b6447e6abb9820589d890c6348241fe16a12c69766c",
+		"8d9ca1163e557208380984c002a340d665b3b769e50d3531fcc025ce7a3867b1964845d99213ecf683b9d0faf77fb33872bf23e735efdfeeebb427cffadaba42"},
+	{4, "alice", "",
+		"00000019706173736869656c642070617373776f7264206d616320763400000005616c6963650000000000000010000102030405060708090a0b0c0d0e0f",
+		"97069dda4ecce028104e24d343f6f0286fe6b7230467d6fc2b756eee25f4fd5d",
+		"a5ff36a141ab7f0839f8ba1e959ea0b8613c5e9b1738500901ce1ffae3d2b5e706d4d635304b1569f89c759136a6eab3314c6af2dea09c9f0ad5944fe32194a4"},
+	{3, "alice", "password",
+		"00000019706173736869656c642070617373776f7264206d61632076330000000870617373776f726400000010000102030405060708090a0b0c0d0e0f",
+		"33372ade0e98d8f8fd3f0c2490ea24cf7fbc9ef2949ee11fba2a922e6e1c47b0",
+		"067f4e302fb203f034033c9fbc5a1e1ba8a9290a9e40108f056924ce126bb3ad9e8021e703fa5d41fed2e1c80d3b3f75f1ff585aff7bda488037df348226c5ce"},
+	{3, "alice", "",
+		"00000019706173736869656c642070617373776f7264206d61632076330000000000000010000102030405060708090a0b0c0d0e0f",
+		"4c9ec3e9b3f65f1bdb87467b81cdee207cd088a8884779fc47b9ee129866853b",
+		"fda714ad2481fe9c97454a2c10fc9543ab716f30b11a7d288a09b5d7cd280d1b4a82f3af84edc945059c5a69a54cb24d5a1d0925c1c6ed0125400f408c475361"},
+	{3, "alice", "pässwörd",
+		"00000019706173736869656c642070617373776f7264206d61632076330000000a70c3a4737377c3b6726400000010000102030405060708090a0b0c0d0e0f",
+		"42cc54b64fa8e6668935442a780bf01fe9e9e0eac2fe521f5e910853f5cf0cf6",
+		"aadc218306065a4fa8e5b06a1a79bbcb5cc362da2dbff021f04e37d535b284149942f247bfc32009aa822af24b01deaeef48f40b8774de9e213cd5abf960bdf5"},
+}
+
+func TestMACInputVectors(t *testing.T) {
+	for _, v := range macInputVectors {
+		record := passwordRecord{Version: v.version, Norm: "none", Salt: vectorSalt}
+		input := encodeInput(v.username, []byte(v.password), record)
+		if got := hex.EncodeToString(input); got != v.input {
+			t.Errorf("v%d %q/%q: input %s, want %s", v.version, v.username, v.password, got, v.input)
+		}
+		for alg, want := range map[string]string{algHmacSHA256: v.sha256, "hmac-sha512": v.sha512} {
+			mac, err := computeMAC(alg, input, vectorKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mac != want {
+				t.Errorf("v%d %q/%q %s: mac %s, want %s", v.version, v.username, v.password, alg, mac, want)
+			}
+		}
+	}
+}
+
+// TestVerifyVectors checks the vectors through a whole record, so the
+// parsing and verification cannot drift from the encoding either.
+func TestVerifyVectors(t *testing.T) {
+	keys := &keyRing{current: "1", keys: map[string][]byte{"1": vectorKey}}
+	for _, v := range macInputVectors {
+		for alg, mac := range map[string]string{algHmacSHA256: v.sha256, "hmac-sha512": v.sha512} {
+			record := passwordRecord{Version: v.version, Alg: alg, KeyID: "1", Norm: "none", Salt: vectorSalt, MAC: mac}
+			parsed, err := parseRecord(record.String(), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ok, err := verifyPassword(v.username, v.password, parsed, keys)
+			if err != nil || !ok {
+				t.Errorf("v%d %q/%q %s: the vector does not verify (%v)", v.version, v.username, v.password, alg, err)
+			}
+			if ok, _ := verifyPassword(v.username, v.password+"x", parsed, keys); ok {
+				t.Errorf("v%d %q/%q %s: a wrong password verifies", v.version, v.username, v.password, alg)
+			}
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/edgelesssys/ego/ecrypto"
+)
+
+// sealKeySize is the size of the AES-256 key used by the software sealer
+const sealKeySize = 32
+
+// Sealer encrypts the state the enclave keeps outside of it (hmac key,
+// attempts map, reset time) and decrypts it again on initialize.
+type Sealer interface {
+	Seal(plaintext []byte) ([]byte, error)
+	Unseal(ciphertext []byte) ([]byte, error)
+}
+
+// egoSealer seals with a key derived from the enclave measurement,
+// so only the same enclave binary on the same CPU can unseal.
+type egoSealer struct{}
+
+func (egoSealer) Seal(plaintext []byte) ([]byte, error) {
+	var additionalData []byte
+	return ecrypto.SealWithUniqueKey(plaintext, additionalData)
+}
+
+func (egoSealer) Unseal(ciphertext []byte) ([]byte, error) {
+	var additionalData []byte
+	return ecrypto.Unseal(ciphertext, additionalData)
+}
+
+// softwareSealer seals with AES-GCM under a key read from a local file.
+// It gives no protection against the host and is meant for development
+// and CI machines without SGX.
+type softwareSealer struct {
+	key []byte
+}
+
+// newSoftwareSealer loads the AES key from keyFile, creating the file
+// with a fresh random key if it does not exist yet.
+func newSoftwareSealer(keyFile string) (*softwareSealer, error) {
+	key, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		key = make([]byte, sealKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+			return nil, err
+		}
+		return &softwareSealer{key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != sealKeySize {
+		return nil, fmt.Errorf("seal key file %s must contain %d bytes, got %d", keyFile, sealKeySize, len(key))
+	}
+	return &softwareSealer{key: key}, nil
+}
+
+func (s *softwareSealer) Seal(plaintext []byte) ([]byte, error) {
+	var additionalData []byte
+	return ecrypto.Encrypt(plaintext, s.key, additionalData)
+}
+
+func (s *softwareSealer) Unseal(ciphertext []byte) ([]byte, error) {
+	var additionalData []byte
+	return ecrypto.Decrypt(ciphertext, s.key, additionalData)
+}
+
+// newSealer returns the sealer selected by name, "ego" or "software".
+func newSealer(name string, keyFile string) (Sealer, error) {
+	switch name {
+	case "ego":
+		return egoSealer{}, nil
+	case "software":
+		return newSoftwareSealer(keyFile)
+	default:
+		return nil, errors.New("unknown sealer: " + name)
+	}
+}
@@ -12,92 +12,190 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/hex"
-	"errors"
+	"flag"
 	"fmt"
 	"math/big"
 	"net/http"
+	"os"
 	"time"
 
-	"database/sql"
 	"encoding/json"
 
-	"github.com/edgelesssys/ego/ecrypto"
-	"github.com/edgelesssys/ego/enclave"
-	_ "github.com/mattn/go-sqlite3"
 	"gopkg.in/square/go-jose.v2/jwt"
 )
 
-// serverAddr is the address of the server
-const serverAddr = "0.0.0.0:8080"
-const saltSize = 16
-const maxAttempts = 3
+func main() {
+	//offline commands that run outside the enclave
+	if len(os.Args) > 1 {
+		var command func([]string) error
+		switch os.Args[1] {
+		case "custodian":
+			command = runCustodian
+		case "legacy-import":
+			command = runLegacyImport
+		}
+		if command != nil {
+			if err := command(os.Args[2:]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
-var token string
-var err error
+	cfg, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
 
-// attestationProviderURL is the URL of the attestation provider
-const attestationProviderURL = "https://shareduks.uks.attest.azure.net"
+	sealer, err := newSealer(cfg.Sealer, cfg.SealKeyFile)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("🆗 Using %s sealer.\n", cfg.Sealer)
+
+	attester, err := newAttester(cfg.Attester, cfg.AttestationProviderURL, cfg.AttestKeyFile)
+	if err != nil {
+		panic(err)
+	}
 
-func main() {
 	// Create a self signed certificate.
 	cert, priv := createCertificate()
 	fmt.Println("🆗 Generated Certificate.")
 
-	// Cerate an Azure Attestation Token.
-	token, err = enclave.CreateAzureAttestationToken(cert, attestationProviderURL)
+	// Cerate an Attestation Token.
+	initialToken, err := attester.Attest(cert)
 	if err != nil {
 		panic(err)
 	}
+	token := &attestationToken{value: initialToken}
 
-	ctx, _ := context.WithCancel(context.Background())
-	go checkTokenExpiration(ctx, token, cert)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go checkTokenExpiration(ctx, token, cert, attester, cfg.TokenCheckInterval.Duration)
 
-	fmt.Println("🆗 Created an Microsoft Azure Attestation Token.")
+	fmt.Printf("🆗 Created an attestation token with the %s attester.\n", cfg.Attester)
 
-	//create database
-	database, err := sql.Open("sqlite3", "./data/password.db")
+	certificate := tls.Certificate{Certificate: [][]byte{cert}, PrivateKey: priv}
+	counter, err := newCounter(cfg, certificate, token)
 	if err != nil {
 		panic(err)
 	}
-	//create Table for username,Hmac and salt.
-	statement, _ := database.Prepare("CREATE TABLE IF NOT EXISTS Hmac (username varchar(50) PRIMARY KEY, hmac varchar(128), salt BLOB)")
-	statement.Exec()
+	if cfg.Counter == "file" {
+		fmt.Println("⚠️ The file counter is controlled by the host and gives no rollback protection.")
+	}
+	state := &sealedState{Sealer: sealer, counter: counter}
 
-	//create Table for Hmac key
-	statement, _ = database.Prepare("CREATE TABLE IF NOT EXISTS Sealed (Hmackey BLOB PRIMARY KEY)")
-	statement.Exec()
+	policy, err := newRecordPolicy(cfg)
+	if err != nil {
+		panic(err)
+	}
 
-	//create Table for salt_with_attempt
-	statement, _ = database.Prepare("CREATE TABLE IF NOT EXISTS salt_with_attempt (data BLOB PRIMARY KEY)")
-	statement.Exec()
+	//open database
+	database, err := newStore(cfg.Store, cfg.DatabaseDSN)
+	if err != nil {
+		panic(err)
+	}
+	defer database.Close()
 
-	//create Table for attemp resetTime
-	statement, _ = database.Prepare("CREATE TABLE IF NOT EXISTS resetTime (time BLOB PRIMARY KEY)")
-	statement.Exec()
+	tlsCfg := tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		// counter peers authenticate with their enclave certificate
+		ClientAuth: tls.RequestClientCert,
+	}
 
-	//create Table for Token key
-	statement, _ = database.Prepare("CREATE TABLE IF NOT EXISTS Token (username varchar(50) PRIMARY KEY, Token varchar(256))")
-	statement.Exec()
+	//restore the hmac key from the custodians' shares
+	if cfg.KeyImport {
+		if err := runKeyImport(cfg, &tlsCfg, attester, token, database, state); err != nil {
+			panic(err)
+		}
+	}
 
 	//generate a random hmac key
-	hmacKey, salt_with_attempt, resetTime, err := initialize(database)
+	lockout, err := parseLockoutSpec(cfg.Lockout)
 	if err != nil {
-		fmt.Println(err)
+		panic(err)
+	}
+	keys, attempts, err := initialize(database, state, bucketLimits{Capacity: cfg.MaxAttempts, Refill: cfg.RefillInterval.Duration}, lockout, cfg.AttemptCache)
+	if err != nil {
+		panic(err)
+	}
+
+	limiters, err := newGuessLimiters(cfg)
+	if err != nil {
+		panic(err)
 	}
 
+	sessions := sessionLimits{TTL: cfg.SessionTTL.Duration, Idle: cfg.SessionIdleTimeout.Duration}
+	go sweepSessions(ctx, database, sessions, cfg.SessionSweepInterval.Duration)
+
 	// Create HTTPS server.
-	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(token)) })
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(token.get())) })
 	http.HandleFunc("/secret", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("📫 %v sent secret %v\n", r.RemoteAddr, r.URL.Query()["s"])
 	})
 
+	//rollback counters of peer enclaves
+	peer, err := newCounterPeer(cfg, sealer)
+	if err != nil {
+		panic(err)
+	}
+	http.HandleFunc("/counter", peer.handler)
+
 	//register
-	http.HandleFunc("/register", func(w http.ResponseWriter, r *http.Request) {
+	http.HandleFunc("/register", registerHandler(keys, database, policy, attempts, limiters, cfg.SaltSize))
+
+	http.HandleFunc("/login", loginHandler(keys, database, policy, attempts, limiters, sessions, cfg.SaltSize))
+
+	//admin
+	wrap := &wrapJob{}
+	http.HandleFunc("/admin/keys", requireAdmin(cfg.AdminTokenHash, keyStatusHandler(keys, database, wrap)))
+	http.HandleFunc("/admin/keys/rotate", requireAdmin(cfg.AdminTokenHash, keyRotateHandler(keys, database, state, wrap)))
+	http.HandleFunc("/admin/keys/wrap", requireAdmin(cfg.AdminTokenHash, keyWrapHandler(keys, database, wrap)))
+	http.HandleFunc("/admin/keys/retire", requireAdmin(cfg.AdminTokenHash, keyRetireHandler(keys, database, state, wrap)))
+	http.HandleFunc("/admin/keys/export", requireAdmin(cfg.AdminTokenHash, keyExportHandler(keys, attester, cfg.Custodians, cfg.CustodianThreshold)))
+	http.HandleFunc("/admin/users/import", requireAdmin(cfg.AdminTokenHash, legacyImportHandler(keys, database, policy, attempts, cfg.SaltSize)))
+	http.HandleFunc("/admin/users/bucket", requireAdmin(cfg.AdminTokenHash, bucketHandler(database, attempts)))
+	http.HandleFunc("/admin/users/unlock", requireAdmin(cfg.AdminTokenHash, unlockHandler(database, attempts)))
+	http.HandleFunc("/admin/users/unlock-token", requireAdmin(cfg.AdminTokenHash, unlockTokenHandler(keys, database, attempts)))
+	http.HandleFunc("/unlock", userUnlockHandler(keys, database, attempts))
+	http.HandleFunc("/admin/users/revoke-sessions", requireAdmin(cfg.AdminTokenHash, revokeSessionsHandler(database)))
+	http.HandleFunc("/session", sessionHandler(database, sessions))
+	http.HandleFunc("/logout", logoutHandler(database))
+
+	//Test only
+	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if err := shutdown(keys, database, attempts, state); err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println("the state information successfully")
+		}
+	})
+
+	server := http.Server{Addr: cfg.ServerAddr, TLSConfig: &tlsCfg}
+	fmt.Printf("📎 Token now available under https://%s/token\n", cfg.ServerAddr)
+	fmt.Printf("👂 Listening on https://%s/secret for secrets...\n", cfg.ServerAddr)
+	err = server.ListenAndServeTLS("", "")
+	fmt.Println(err)
+}
+
+// registerHandler stores a new user. An existing username gets the same
+// answer after the same sealed write, so it cannot be found this way.
+func registerHandler(keys *keyRing, database Store, policy recordPolicy, attempts *attemptLog, limiters *guessLimiters, saltSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Only GET requests are allowed", http.StatusBadRequest)
 			return
 		}
 
+		//probes for existing usernames count like login guesses
+		if !limiters.allow(w, r) {
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
 			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
@@ -112,73 +210,83 @@ func main() {
 
 		// generate a random salt with 10 rounds of complexity
 		var salt = generateRandomSalt(saltSize)
-		saltKey := fmt.Sprintf("%x", salt)
-
-		//salting the password
-		var salting = salting(pwd, salt)
 
-		//generate hmac
-		var hmac = genHmac(salting, hmacKey)
+		//generate the versioned record of the hmac
+		record, err := createRecord(username, pwd, salt, keys, policy)
+		if err == errInvalidPassword {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to compute the password record", http.StatusInternalServerError)
+			return
+		}
 
 		//insert data into DB
-		if err := AddSaltAndHmac(username, hmac, salt, database); err != nil {
-
-			//if the username already exist in DB sent err
-			//w.Write([]byte(fmt.Sprintf("username %s already exist in DB. Error: %s", username, err.Error())))
-			w.Write([]byte(`<!DOCTYPE html>
-			<html>
-			  <head>
-				<meta charset='utf-8'>
-				<title>registeration failed</title>
-			  </head>
-			  <body>
-				<h1>Sorry, your registration is failed.</h1>
-				<h1>the username you entered is already existed.</h1>
-				<hr>
-				<a href="https://www.passhield.com"><button>Login</button></a>
-				<a href="https://www.passhield.com/register"><button>Register</button></a>
-			  </body>
-			</html>
-			`))
+		err = database.AddSaltAndHmac(username, record.String(), salt)
+		if err == ErrExists {
+			//an existing username gets the sealed write and the answer of
+			//a new one, so registration cannot be used to find usernames
 			fmt.Println(err)
+			phantomKey, _, err := phantomUser(username, saltSize, keys, policy)
+			if err == nil {
+				err = attempts.fill(phantomKey)
+			}
+			if err != nil {
+				fmt.Println(err)
+			}
+		} else if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to store the user", http.StatusInternalServerError)
+			return
 		} else {
 			//init the salt_with_attempt
-			salt_with_attempt[saltKey] = maxAttempts
+			if err := attempts.fill(bucketKey(record)); err != nil {
+				fmt.Println(err)
+			}
 
 			//test only
 			fmt.Println("Salt: ", salt)
-			fmt.Println("Salted byte: ", salting)
-			fmt.Println("hmac: ", hmac)
-
-			//w.Write([]byte(fmt.Sprintf("register success")))
-			w.Write([]byte(`<!DOCTYPE html>
-			<html>
-			  <head>
-				<meta charset='utf-8'>
-				<title>register successful</title>
-			  </head>
-			  <body>
-				<h1>Congratulations, your registration is successful!</h1>
-				<hr>
-				<p>Thank you for registering with our website, you can now log in with your account and start using our services.</p>
-				<a href="https://www.passhield.com"><button>Login</button></a>
-			  </body>
-			</html>
-			`))
-			//test only
-			//w.Write([]byte(fmt.Sprintf("username: %s", username)))
-			//w.Write([]byte(fmt.Sprintf("hmac: %s ", hmac)))
-			//w.Write([]byte(fmt.Sprintf("salt: %s ", salt)))
-
+			fmt.Println("record: ", record)
 		}
-	})
 
-	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		//w.Write([]byte(fmt.Sprintf("register success")))
+		w.Write([]byte(`<!DOCTYPE html>
+		<html>
+		  <head>
+			<meta charset='utf-8'>
+			<title>register successful</title>
+		  </head>
+		  <body>
+			<h1>Congratulations, your registration is successful!</h1>
+			<hr>
+			<p>Thank you for registering with our website, you can now log in with your account and start using our services.</p>
+			<a href="https://www.passhield.com"><button>Login</button></a>
+		  </body>
+		</html>
+		`))
+		//test only
+		//w.Write([]byte(fmt.Sprintf("username: %s", username)))
+		//w.Write([]byte(fmt.Sprintf("hmac: %s ", hmac)))
+		//w.Write([]byte(fmt.Sprintf("salt: %s ", salt)))
+	}
+}
+
+// loginHandler checks a password and answers with the token of a new
+// session. Unknown usernames get the answers of a wrong password.
+func loginHandler(keys *keyRing, database Store, policy recordPolicy, attempts *attemptLog, limiters *guessLimiters, sessions sessionLimits, saltSize int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Only GET requests are allowed", http.StatusBadRequest)
 			return
 		}
 
+		//every request is a guess, for existing usernames or not
+		if !limiters.allow(w, r) {
+			return
+		}
+
 		err := r.ParseForm()
 		if err != nil {
 			http.Error(w, "Failed to parse request body", http.StatusBadRequest)
@@ -193,13 +301,72 @@ func main() {
 
 		//Rate limiting
 
-		salt, hmac, err := GetSaltAndHmac(username, database)
+		salt, stored, err := database.GetSaltAndHmac(username)
+		if err != nil && err != ErrNotFound {
+			fmt.Println(err)
+			http.Error(w, "Failed to read the user", http.StatusInternalServerError)
+			return
+		}
 
+		//an unknown username takes the path of a wrong password, with a
+		//phantom bucket and record, so probes cannot tell it apart
+		var record passwordRecord
+		var saltKey string
+		if err == ErrNotFound {
+			saltKey, record, err = phantomUser(username, saltSize, keys, policy)
+		} else {
+			record, err = parseRecord(stored, salt)
+			saltKey = bucketKey(record)
+		}
 		if err != nil {
-			if err == sql.ErrNoRows {
-				fmt.Printf("username is not in the Database")
-				w.WriteHeader(http.StatusNotFound)
-				//w.Write([]byte(fmt.Sprintf("Record not found for username %s: . Error: %s", username, err.Error())))
+			fmt.Println(err)
+			http.Error(w, "Stored password record is invalid", http.StatusInternalServerError)
+			return
+		}
+
+		//test only
+		fmt.Println("record from DB: ", stored)
+
+		//test only
+		//w.Write([]byte(fmt.Sprintf("username: %s", username)))
+		//the attempt is logged before the password is checked
+		if b, err := decrementAttempts(saltKey, attempts); err != nil {
+			fmt.Println(err)
+			if err == errNoAttempts || err == errLocked {
+				writeLocked(w, b, attempts.limits, time.Now())
+			}
+		} else {
+			//recompute the hmac the way the record says
+			login, err := verifyPassword(username, pwd, record, keys)
+			if err != nil {
+				fmt.Println(err)
+			}
+			if login == true {
+				fmt.Println("Verification success")
+
+				//a success restores the budget the failures before it took
+				if err := attempts.refund(saltKey); err != nil {
+					fmt.Println(err)
+				}
+
+				//move the record to the current hmac key
+				if err := rekeyRecord(username, stored, pwd, record, keys, policy, database); err != nil {
+					fmt.Println(err)
+				}
+				//test only
+				//w.Write([]byte(fmt.Sprintf("Verification success")))
+
+				//sent the token of a new session
+				random_token, err := newSession(database, sessions, username)
+				if err != nil {
+					fmt.Println(err)
+				} else {
+					w.Write([]byte(random_token))
+				}
+			} else {
+				fmt.Println("Verification failure")
+				//test only
+				//w.Write([]byte(fmt.Sprintf("Verification failure")))
 				w.Write([]byte(`<!DOCTYPE html>
 					<html>
 					<head>
@@ -208,7 +375,7 @@ func main() {
 					</head>
 					<body>
 						<h1>Sorry, login is failed.</h1>
-						<h1>the username is not existed in database</h1>
+						<h1>the username or password is not correct</h1>
 						<hr>
 						<a href="https://www.passhield.com"><button>Login</button></a>
 						<a href="https://www.passhield.com/register"><button>Register</button></a>
@@ -216,259 +383,58 @@ func main() {
 					</html>
 				`))
 			}
-		} else {
-			var salting = salting(pwd, salt)
-
-			//test only
-			fmt.Println("Salted byte: ", salting)
-			fmt.Println("hmac from DB: ", hmac)
-
-			var newHmac = genHmac(salting, hmacKey)
-
-			//test only
-			fmt.Println("newhmac: ", newHmac)
-
-			//test only
-			//w.Write([]byte(fmt.Sprintf("username: %s", username)))
-			//w.Write([]byte(fmt.Sprintf("salting: %s ", salting)))
-			if err := decrementAttempts(salt, salt_with_attempt); err != nil {
-				fmt.Println(err)
-				resetAttempts(salt_with_attempt, resetTime, maxAttempts)
-			} else {
-				if login := compareHMACs(hmac, newHmac); login == true {
-					fmt.Println("Verification success")
-					//test only
-					//w.Write([]byte(fmt.Sprintf("Verification success")))
-
-					//sent token
-					random_token, err := GenerateRandomString(256)
-					if err != nil {
-						fmt.Println(err)
-					} else {
-						//save token in DB
-						if err := AddToken(username, random_token, database); err != nil {
-							fmt.Println(err)
-						} else {
-							w.Write([]byte(fmt.Sprintf(random_token)))
-						}
-					}
-				} else {
-					fmt.Println("Verification failure")
-					//test only
-					//w.Write([]byte(fmt.Sprintf("Verification failure")))
-					w.Write([]byte(`<!DOCTYPE html>
-						<html>
-						<head>
-							<meta charset='utf-8'>
-							<title>login failed</title>
-						</head>
-						<body>
-							<h1>Sorry, login is failed.</h1>
-							<h1>password is not matched with your username</h1>
-							<hr>
-							<a href="https://www.passhield.com"><button>Login</button></a>
-							<a href="https://www.passhield.com/register"><button>Register</button></a>
-						</body>
-						</html>
-					`))
-				}
-			}
-		}
-	})
-
-	//Test only
-	http.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
-		if err := shutdown(hmacKey, database, salt_with_attempt, resetTime); err != nil {
-			fmt.Println(err)
-		} else {
-			fmt.Println("the state information successfully")
 		}
-	})
-
-	tlsCfg := tls.Config{
-		Certificates: []tls.Certificate{
-			{
-				Certificate: [][]byte{cert},
-				PrivateKey:  priv,
-			},
-		},
 	}
-
-	server := http.Server{Addr: serverAddr, TLSConfig: &tlsCfg}
-	fmt.Printf("📎 Token now available under https://%s/token\n", serverAddr)
-	fmt.Printf("👂 Listening on https://%s/secret for secrets...\n", serverAddr)
-	err = server.ListenAndServeTLS("", "")
-	fmt.Println(err)
 }
 
-func AddToken(username string, Token string, database *sql.DB) error {
-	var count int
-	row := database.QueryRow("SELECT COUNT(*) FROM Token WHERE username = ?", username)
-	if err := row.Scan(&count); err != nil {
-		return err
-	}
-	if count > 0 {
-		//delete all the row from table Token
-		statement, err := database.Prepare("DELETE FROM Token WHERE username = ?")
-		if err != nil {
-			return err
-		}
-		_, err = statement.Exec(username)
-		if err != nil {
-			return err
-		}
-	}
-	statement, err := database.Prepare("INSERT INTO Token (username, Token) VALUES (?, ?)")
-	if err != nil {
-		return err
-	}
-	defer statement.Close()
-	_, err = statement.Exec(username, Token)
-	return err
-}
-
-// resetAttempts resets the number of attempts for each salt in the given attempts
-// map to the maximum number of attempts and updates the resetTime to be one day
-// later if the current time is after the resetTime.
+// decrementAttempts takes one attempt from the token bucket of the given
+// salt, after adding the attempts regained since it was last refilled.
 //
 // Parameters:
-//   - attempts: a map that contains the number of attempts for each salt
-//   - resetTime: a pointer to a time.Time variable that stores the time when the
-//     attempts were last reset
-//   - attemptsmax: the maximum number of attempts allowed for each salt
-func resetAttempts(attempts map[string]int, resetTime *time.Time, attemptsmax int) {
-	now := time.Now()
-
-	// If the current time is after the resetTime, reset the attempts for each salt
-	if now.After(*resetTime) {
-		for salt := range attempts {
-			attempts[salt] = attemptsmax
-		}
-
-		// Update the resetTime to be one day later
-		*resetTime = now.Add(time.Hour * 24)
-	}
-}
-
-// decrementAttempts decrements the number of attempts associated with the given
-// salt in the provided map salt_with_attempt. If the salt is not found in the map,
-// an error is returned. If the number of attempts reaches zero, an error is also
-// returned. Otherwise, the attempts counter is decremented by one and the function
-// returns nil.
-//
-// Parameters:
-//   - salt: a byte slice representing the salt to decrement attempts for.
-//   - salt_with_attempt: a map[string]int where keys are salt values (as hex strings)
-//     and values are the corresponding number of attempts.
+//   - saltKey: the salt (as hex string) to decrement attempts for, or the
+//     phantom key of an unknown username.
+//   - attempts: the attempt log whose map has salt values (as hex strings) as
+//     keys and the corresponding token buckets as values.
 //
 // Returns:
-// - an error if the salt is not found in the map or the number of attempts is zero.
+// - the bucket, for the response to a locked account.
+// - errLocked or errNoAttempts if the account is locked or out of attempts.
+// - another error if the salt is not found or logging failed.
 // - nil otherwise.
-func decrementAttempts(salt []byte, salt_with_attempt map[string]int) error {
-	saltKey := fmt.Sprintf("%x", salt)
-	attempt, ok := salt_with_attempt[saltKey]
-	if !ok {
-		return errors.New("salt not found in attempts map")
-	}
-	if attempt == 0 {
-		return errors.New("no attempts left")
-	}
-	salt_with_attempt[saltKey] = attempt - 1
-	return nil
+func decrementAttempts(saltKey string, attempts *attemptLog) (bucket, error) {
+	return attempts.take(saltKey)
 }
 
 // securely stores the state information outside the enclave when systeam is shutting down.
-// input hmacKey return error if exits
-func shutdown(hmacKey []byte, database *sql.DB, salt_with_attempt map[string]int, resetTime *time.Time) error {
-	if err := stores_HmacKey(hmacKey, database); err != nil {
+// input hmac key ring return error if exits
+// every change of the attempts is already in the attempt log, so this only
+// compacts the log into a snapshot.
+func shutdown(keys *keyRing, database StateStore, attempts *attemptLog, state *sealedState) error {
+	if err := stores_HmacKey(keys, database, state); err != nil {
 		fmt.Println(err)
 	}
-	if err := stores_salt_with_attempt(salt_with_attempt, resetTime, database); err != nil {
-		return err
-	}
-
-	return err
+	return attempts.snapshot()
 }
 
-func stores_salt_with_attempt(salt_with_attempt map[string]int, resetTime *time.Time, database *sql.DB) error {
-	var count int
-	row := database.QueryRow("SELECT COUNT(*) FROM salt_with_attempt")
-	if err := row.Scan(&count); err != nil {
-		return err
-	}
-	// first checks if an Hmac already exists
-	//in the Sealed table of the provided database
-	//and returns an error if it does.
-	if count > 0 {
-		//delete all the row from table salt_with_attempt
-		statement, err := database.Prepare("DELETE FROM salt_with_attempt;")
-		if err != nil {
-			return err
-		}
-		_, err = statement.Exec()
-		if err != nil {
-			return err
-		}
-
-		//delete all the row from table salt_with_attempt
-		statement, err = database.Prepare("DELETE FROM resetTime;")
-		if err != nil {
-			return err
-		}
-		_, err = statement.Exec()
-		if err != nil {
-			return err
-		}
-	}
-
-	jsonData, err := json.Marshal(salt_with_attempt)
-	if err != nil {
-		return err
-	}
-
-	var Sealed_jsonData = sealing(jsonData)
-	_, err = database.Exec("INSERT INTO salt_with_attempt (data) VALUES (?)", Sealed_jsonData)
-	if err != nil {
-		return err
-	}
-
-	statement, err := database.Prepare("INSERT INTO resetTime (time) VALUES (?)")
-	if err != nil {
-		return err
-	}
-	defer statement.Close()
-
-	resetTimeStr := resetTime.Format(time.RFC3339) // Convert to ISO 8601 format
-	var resetTime_byte = []byte(resetTimeStr)
-	var Sealed_resetTime = sealing(resetTime_byte)
-	_, err = statement.Exec(Sealed_resetTime)
-
-	return err
+// seals the hmac key ring as it is and replaces the stored one. Changes of
+// the ring are stored through ringSaver before they are used.
+func stores_HmacKey(keys *keyRing, database StateStore, state *sealedState) error {
+	return keys.change(nil, ringSaver(database, state))
 }
 
-func stores_HmacKey(hmacKey []byte, database *sql.DB) error {
-	var count int
-	row := database.QueryRow("SELECT COUNT(*) FROM Sealed")
-	if err := row.Scan(&count); err != nil {
-		return err
-	}
-	// first checks if an Hmac already exists
-	//in the Sealed table of the provided database
-	//and returns an error if it does.
-	if count > 0 {
-		return errors.New("Hmac already exists")
-	}
-	// If no Hmac exists, the function prepares an INSERT statement
-	//to insert the hmacKey into the Sealed table and executes it.
-	statement, err := database.Prepare("INSERT INTO Sealed (Hmackey) VALUES (?)")
-	if err != nil {
-		return err
+// ringSaver returns the save function for keyRing changes, which seals
+// the marshaled ring and replaces the stored one. The changes of the ring
+// are serialized, so a newer ring is never sealed with an older version.
+func ringSaver(database StateStore, state *sealedState) func(data []byte) error {
+	return func(data []byte) error {
+		return state.update(stateRing, func(seal sealFunc) error {
+			Seal, err := seal(stateRing, data)
+			if err != nil {
+				return err
+			}
+			return database.PutSealedHmacKey(Seal)
+		})
 	}
-	defer statement.Close()
-	var Seal = sealing(hmacKey)
-	_, err = statement.Exec(Seal)
-
-	return err
 }
 
 // input hmac from DB and newhmac return bool
@@ -490,127 +456,98 @@ func compareHMACs(hmac1, hmac2 string) bool {
 	return subtle.ConstantTimeCompare(byteHMAC1, byteHMAC2) == 1
 }
 
-// Determine if username already exists in the
-// database if not add the three inputs to the database
-// if it does return an error message
-func AddSaltAndHmac(username string, hmac string, salt []byte, database *sql.DB) error {
-	var count int
-	row := database.QueryRow("SELECT COUNT(*) FROM Hmac WHERE username = ?", username)
-	if err := row.Scan(&count); err != nil {
-		return err
-	}
-	if count > 0 {
-		return errors.New("username already exists")
-	}
-	statement, err := database.Prepare("INSERT INTO Hmac (username, hmac, salt) VALUES (?, ?, ?)")
-	if err != nil {
-		return err
-	}
-	defer statement.Close()
-	_, err = statement.Exec(username, hmac, salt)
-	return err
-}
-
-// input username return salt and hmac.
-// Determine if username already exists in the database
-// if not  return an error message if it does return  salt and hmac.
-func GetSaltAndHmac(username string, database *sql.DB) ([]byte, string, error) {
-	// Execute the selection statement salt and HMAC value
-	rows, err := database.Query("SELECT hmac, salt FROM Hmac WHERE username = ?", username)
-	if err != nil {
-		return nil, "", err
-	}
-	defer rows.Close()
-
-	var salt []byte
-	var hmac string
+// unseal the hmac key ring and the attempts state and replay the attempt
+// log, or generate a new random hmac key and seal it on the first start.
+// The state must be the newest one the rollback counter knows of.
+func initialize(database StateStore, state *sealedState, limits bucketLimits, lockout *lockoutSpec, cache int) (*keyRing, *attemptLog, error) {
+	attempts := newAttemptLog(database, state, limits, lockout, cache)
+	Seal, err := database.GetSealedHmacKey()
+	if err != nil && err != ErrNotFound {
+		return nil, nil, err
+	}
+	if err == ErrNotFound {
+		// no state at all is only fine if the counter never moved
+		if err := state.start(stateEnvelope{}, 0, 0); err != nil {
+			return nil, nil, err
+		}
 
-	// Traversing the query results, store the salt and HMAC values into the variable
-	for rows.Next() {
-		err = rows.Scan(&hmac, &salt)
+		//generate a random hmac key
+		keys, err := newKeyRing()
 		if err != nil {
-			return nil, "", err
+			return nil, nil, err
+		}
+		if err := stores_HmacKey(keys, database, state); err != nil {
+			return nil, nil, err
 		}
-	}
 
-	if salt == nil || hmac == "" {
-		return nil, "", sql.ErrNoRows
+		return keys, attempts, nil
 	}
 
-	return salt, hmac, nil
-}
+	data, ring, err := state.open(stateRing, Seal)
+	if err != nil {
+		return nil, nil, err
+	}
+	keys, err := unmarshalKeyRing(data)
+	if err != nil {
+		return nil, nil, err
+	}
 
-// generate a random hmac key and seal it
-func initialize(database *sql.DB) ([]byte, map[string]int, *time.Time, error) {
-	var count int
-	row := database.QueryRow("SELECT COUNT(*) FROM Sealed")
-	if err := row.Scan(&count); err != nil {
-		return nil, nil, nil, err
+	// the key was stored but maybe no snapshot was taken yet, then the
+	// whole attempts state is in the attempt log
+	var snapshotEnvelope stateEnvelope
+	upgraded := false
+	jsonData, err := database.GetSealedAttempts()
+	if err != nil && err != ErrNotFound {
+		return nil, nil, err
 	}
-	if count > 0 {
-		// Execute the selection statement Hmackey value
-		rows, err := database.Query("SELECT Hmackey FROM Sealed")
+	if err == nil {
+		UnSeal_jsonData, envelope, err := state.open(stateAttempts, jsonData)
 		if err != nil {
-			return nil, nil, nil, err
+			return nil, nil, err
 		}
-		defer rows.Close()
-		var Seal []byte
-
-		// Traversing the query results, store the salt and HMAC values into the variable
-		for rows.Next() {
-			err = rows.Scan(&Seal)
-			if err != nil {
-				return nil, nil, nil, err
+		var snapshot attemptSnapshot
+		err = json.Unmarshal(UnSeal_jsonData, &snapshot)
+		switch {
+		case err == nil && snapshot.Partitions != nil:
+			if len(snapshot.Partitions) != attemptPartitions {
+				return nil, nil, errPartitions
 			}
+			attempts.versions, attempts.seq = snapshot.Partitions, snapshot.Seq
+		default:
+			if err != nil || snapshot.Buckets == nil && snapshot.Attempts == nil {
+				// a bare map from before the attempt log
+				if err := json.Unmarshal(UnSeal_jsonData, &snapshot.Attempts); err != nil {
+					return nil, nil, err
+				}
+				snapshot.Seq = 0
+			}
+			if snapshot.Buckets == nil {
+				// attempts from before the token buckets start refilling now
+				snapshot.Buckets = make(map[string]bucket)
+				for salt, left := range snapshot.Attempts {
+					snapshot.Buckets[salt] = bucket{Tokens: left, Refilled: time.Now()}
+				}
+			}
+			// a snapshot from before the partitions is split into them
+			attempts.loadLegacy(snapshot.Buckets, snapshot.Seq)
+			upgraded = true
 		}
-		if Seal == nil {
-			return nil, nil, nil, err
-		}
-		var hmac = Unseal(Seal)
-
-		//test only
-		//fmt.Printf("init() unSeal hmac key: %s", hmac)
-
-		var jsonData []byte
-		err = database.QueryRow("SELECT data FROM salt_with_attempt").Scan(&jsonData)
-		if err != nil {
-			return nil, nil, nil, err
-		}
-		var UnSeal_jsonData = Unseal(jsonData)
-		var saltWithAttempt map[string]int
-		err = json.Unmarshal(UnSeal_jsonData, &saltWithAttempt)
-		if err != nil {
-			return nil, nil, nil, err
-		}
-
-		var timeBytes []byte
-		err = database.QueryRow("SELECT time FROM resetTime").Scan(&timeBytes)
-		if err != nil {
-			return nil, nil, nil, err
-		}
-		var UnSeal_time = Unseal(timeBytes)
-		resetTimeStr := string(UnSeal_time)
-		resetTime, err := time.Parse(time.RFC3339, resetTimeStr)
-		if err != nil {
-			return nil, nil, nil, err
-		}
+		snapshotEnvelope = envelope
+	}
 
-		return hmac, saltWithAttempt, &resetTime, err
-	} else {
-		//generate a random hmac key
-		random_hmackey, err := GenerateRandomString(128)
-		if err != nil {
-			return nil, nil, nil, err
+	last, err := attempts.replay(snapshotEnvelope)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := state.start(newer(ring, last), ring.Version, last.Version); err != nil {
+		return nil, nil, err
+	}
+	if upgraded {
+		if err := attempts.snapshot(); err != nil {
+			return nil, nil, err
 		}
-		fmt.Println("random_hmackey: ", random_hmackey)
-		fmt.Println("*********************************************************************************************************************************************************************************************************")
-		var keyBytes = []byte(random_hmackey)
-
-		salt_with_attempt := make(map[string]int)
-		resetTime := time.Now().Add(time.Minute * 1)
-
-		return keyBytes, salt_with_attempt, &resetTime, err
 	}
+	return keys, attempts, nil
 }
 
 func GenerateRandomString(n int) (string, error) {
@@ -627,28 +564,6 @@ func GenerateRandomString(n int) (string, error) {
 	return string(ret), nil
 }
 
-// seal the Hmac key
-func sealing(hmacKey []byte) []byte {
-	var additionalData []byte
-	seal, err := ecrypto.SealWithUniqueKey(hmacKey, additionalData)
-
-	if err != nil {
-		panic(err)
-	}
-	return seal
-}
-
-// Unseal the Hmac key
-func Unseal(hmacKey []byte) []byte {
-	var additionalData []byte
-	hmac_key, err := ecrypto.Unseal(hmacKey, additionalData)
-
-	if err != nil {
-		panic(err)
-	}
-	return hmac_key
-}
-
 func generateRandomSalt(saltSize int) []byte {
 	var salt = make([]byte, saltSize)
 
@@ -697,9 +612,8 @@ func createCertificate() ([]byte, crypto.PrivateKey) {
 	return cert, priv
 }
 
-func checkTokenExpiration(ctx context.Context, tokenString string, cert []byte) {
-	//ticker := time.NewTicker(480 * time.Minute)
-	ticker := time.NewTicker(8 * time.Hour)
+func checkTokenExpiration(ctx context.Context, token *attestationToken, cert []byte, attester Attester, interval time.Duration) {
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
@@ -708,7 +622,7 @@ func checkTokenExpiration(ctx context.Context, tokenString string, cert []byte)
 			fmt.Println("Token expiration checker stopped.")
 			return
 		case <-ticker.C:
-			tokenTmp, err := jwt.ParseSigned(tokenString)
+			tokenTmp, err := jwt.ParseSigned(token.get())
 			if err != nil {
 				fmt.Printf("Failed to parse token: %v\n", err)
 				continue
@@ -726,13 +640,13 @@ func checkTokenExpiration(ctx context.Context, tokenString string, cert []byte)
 				// Token expired
 				fmt.Println("Token has expired. Renewing token...")
 
-				newToken, err := enclave.CreateAzureAttestationToken(cert, attestationProviderURL)
+				newToken, err := attester.Attest(cert)
 				if err != nil {
 					fmt.Printf("Failed to renew token: %v\n", err)
 					continue
 				}
 
-				token = newToken
+				token.set(newToken)
 				fmt.Println("Token renewed successfully.")
 			} else {
 				fmt.Println("Token is still valid.")
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServer wires the handlers to a memory store and a fresh attempt
+// log, without limiters per client.
+type testServer struct {
+	keys     *keyRing
+	database Store
+	attempts *attemptLog
+	policy   recordPolicy
+	register http.HandlerFunc
+	login    http.HandlerFunc
+}
+
+func newTestServer(t *testing.T, maxAttempts int, lockout string) *testServer {
+	keys, err := newKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec, err := parseLockoutSpec(lockout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.ClientLimit, cfg.SubnetLimit, cfg.GlobalLimit = "none", "none", "none"
+	limiters, err := newGuessLimiters(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{keys: keys, database: newMemoryStore(), policy: recordPolicy{Alg: algHmacSHA256, Norm: "none"}}
+	state := &sealedState{Sealer: &softwareSealer{key: make([]byte, sealKeySize)}, counter: &memoryCounter{}}
+	s.attempts = newAttemptLog(s.database, state, bucketLimits{Capacity: maxAttempts, Refill: time.Hour}, spec, 16)
+	sessions := sessionLimits{TTL: time.Hour}
+	s.register = registerHandler(keys, s.database, s.policy, s.attempts, limiters, cfg.SaltSize)
+	s.login = loginHandler(keys, s.database, s.policy, s.attempts, limiters, sessions, cfg.SaltSize)
+	return s
+}
+
+// get calls handler with the username and password as query.
+func (s *testServer) get(handler http.HandlerFunc, username string, password string) *httptest.ResponseRecorder {
+	query := url.Values{"username": {username}, "password": {password}}
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/?"+query.Encode(), nil))
+	return w
+}
+
+// loginFailed is part of the answer to a wrong password
+const loginFailed = "the username or password is not correct"
+
+func TestRegisterLogin(t *testing.T) {
+	s := newTestServer(t, 3, "none")
+
+	w := s.get(s.register, "alice", "password")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "registration is successful") {
+		t.Fatalf("register: %d %s", w.Code, w.Body.String())
+	}
+	_, stored, err := s.database.GetSaltAndHmac("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a second registration answers the same and keeps the first record
+	again := s.get(s.register, "alice", "other")
+	if again.Code != w.Code || again.Body.String() != w.Body.String() {
+		t.Errorf("registering an existing username answers %d %s", again.Code, again.Body.String())
+	}
+	if _, now, _ := s.database.GetSaltAndHmac("alice"); now != stored {
+		t.Error("registering an existing username replaced its record")
+	}
+
+	w = s.get(s.login, "alice", "password")
+	token := w.Body.String()
+	if w.Code != http.StatusOK || len(token) != sessionTokenSize {
+		t.Fatalf("login: %d %s", w.Code, token)
+	}
+	if found, err := s.database.GetSession(sessionHash(token)); err != nil || found.Username != "alice" {
+		t.Errorf("login did not start a session for alice (%v)", err)
+	}
+
+	for _, pwd := range []string{"other", "Password", ""} {
+		if w = s.get(s.login, "alice", pwd); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), loginFailed) {
+			t.Errorf("login with %q: %d %s", pwd, w.Code, w.Body.String())
+		}
+	}
+
+	w = httptest.NewRecorder()
+	s.register(w, httptest.NewRequest("POST", "/register", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /register: %d", w.Code)
+	}
+}
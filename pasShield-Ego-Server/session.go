@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// sessionTokenSize is the length of a session token in characters
+const sessionTokenSize = 256
+
+// session is a login session. Its token is only stored as a hash, so a
+// copy of the database does not hand out live sessions.
+type session struct {
+	Username string
+	Created  time.Time
+	LastSeen time.Time
+	Expires  time.Time
+}
+
+// sessionLimits are how long a session lives at most and how long it may
+// go unused; Idle 0 never ends a session for being unused.
+type sessionLimits struct {
+	TTL  time.Duration
+	Idle time.Duration
+}
+
+// sessionStatus is the answer of /session.
+type sessionStatus struct {
+	Username    string     `json:"username"`
+	Expires     time.Time  `json:"expires"`
+	IdleExpires *time.Time `json:"idleExpires,omitempty"`
+}
+
+// sessionHash returns the key a session token is stored under.
+func sessionHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// valid tells whether s has neither expired nor been idle too long at now.
+func (limits sessionLimits) valid(s session, now time.Time) bool {
+	if !now.Before(s.Expires) {
+		return false
+	}
+	return limits.Idle == 0 || now.Before(s.LastSeen.Add(limits.Idle))
+}
+
+// newSession starts a session for username and returns its token.
+func newSession(database SessionStore, limits sessionLimits, username string) (string, error) {
+	token, err := GenerateRandomString(sessionTokenSize)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	s := session{Username: username, Created: now, LastSeen: now, Expires: now.Add(limits.TTL)}
+	if err := database.AddSession(sessionHash(token), s); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// bearerToken returns the token of "Authorization: Bearer <token>".
+func bearerToken(r *http.Request) string {
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// sessionHandler checks the session token the client sends as bearer
+// token, e.g. for an application server, and counts it as a use of the
+// session for the idle timeout.
+func sessionHandler(database SessionStore, limits sessionLimits) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Only GET requests are allowed", http.StatusBadRequest)
+			return
+		}
+		hash := sessionHash(bearerToken(r))
+		s, err := database.GetSession(hash)
+		if err != nil && err != ErrNotFound {
+			fmt.Println(err)
+			http.Error(w, "Failed to read the session", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		if err == ErrNotFound || !limits.valid(s, now) {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+		if err := database.TouchSession(hash, now); err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to update the session", http.StatusInternalServerError)
+			return
+		}
+		status := sessionStatus{Username: s.Username, Expires: s.Expires.UTC().Truncate(time.Second)}
+		if limits.Idle != 0 {
+			idle := now.Add(limits.Idle).UTC().Truncate(time.Second)
+			status.IdleExpires = &idle
+		}
+		writeJSON(w, status)
+	}
+}
+
+// logoutHandler ends the session of the bearer token.
+func logoutHandler(database SessionStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		err := database.DeleteSession(sessionHash(bearerToken(r)))
+		if err == ErrNotFound {
+			http.Error(w, "Invalid or expired session", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to end the session", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("Logged out"))
+	}
+}
+
+// revokeSessionsResponse is the answer of the admin session revocation.
+type revokeSessionsResponse struct {
+	Username string `json:"username"`
+	Revoked  int64  `json:"revoked"`
+}
+
+// revokeSessionsHandler lets an admin end every session of the account
+// given by the username query parameter, e.g. after its token was stolen.
+func revokeSessionsHandler(database Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		username := r.URL.Query().Get("username")
+		if _, _, err := database.GetSaltAndHmac(username); err == ErrNotFound {
+			http.Error(w, "Unknown username", http.StatusNotFound)
+			return
+		} else if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to read the user", http.StatusInternalServerError)
+			return
+		}
+		revoked, err := database.DeleteUserSessions(username)
+		if err != nil {
+			fmt.Println(err)
+			http.Error(w, "Failed to revoke the sessions", http.StatusInternalServerError)
+			return
+		}
+		fmt.Printf("🚪 Admin revoked %d sessions of %s\n", revoked, username)
+		writeJSON(w, revokeSessionsResponse{Username: username, Revoked: revoked})
+	}
+}
+
+// sweepSessions deletes the expired and idle sessions every interval until
+// ctx is cancelled. Expired sessions are refused before they are swept;
+// the sweep only keeps the table small.
+func sweepSessions(ctx context.Context, database SessionStore, limits sessionLimits, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			// no session was used before the epoch
+			idleBefore := time.Unix(0, 0)
+			if limits.Idle != 0 {
+				idleBefore = now.Add(-limits.Idle)
+			}
+			swept, err := database.DeleteExpiredSessions(now, idleBefore)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if swept > 0 {
+				fmt.Printf("🧹 Swept %d expired sessions.\n", swept)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("the hmac key ring, any length")
+	for _, c := range []struct{ n, threshold int }{{2, 2}, {3, 2}, {5, 3}, {10, 10}} {
+		shares, err := splitSecret(secret, c.n, c.threshold)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// every window of threshold shares rebuilds the secret
+		for i := 0; i+c.threshold <= c.n; i++ {
+			combined, err := combineShares(shares[i : i+c.threshold])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(combined, secret) {
+				t.Errorf("%d-of-%d: shares %d.. rebuild %x", c.threshold, c.n, i, combined)
+			}
+		}
+	}
+}
+
+func TestCombineBelowThreshold(t *testing.T) {
+	secret := []byte("the hmac key ring")
+	shares, err := splitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err := combineShares(shares[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error("two shares of a 3-of-5 split rebuild the secret")
+	}
+}
+
+func TestCombineWrongShare(t *testing.T) {
+	secret := []byte("the hmac key ring")
+	shares, err := splitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := append([]byte(nil), shares[1]...)
+	wrong[3] ^= 1
+	combined, err := combineShares([][]byte{shares[0], wrong})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Error("a changed share still rebuilds the secret")
+	}
+	if _, err := combineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("duplicate shares are combined")
+	}
+	if _, err := combineShares([][]byte{shares[0], shares[1][:4]}); err == nil {
+		t.Error("shares of different lengths are combined")
+	}
+	if _, err := splitSecret(secret, 3, 4); err == nil {
+		t.Error("a threshold above the number of shares is accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// kinds of sealed blobs; a blob opened as the wrong kind is rejected, so
+// the host cannot store one in place of another
+const (
+	stateRing      = "ring"
+	stateAttempts  = "attempts"
+	stateLogEntry  = "log"
+	statePartition = "partition"
+)
+
+// stateEnvelope wraps every sealed blob. Each change of the state takes
+// the next version, and Ring and Attempts are the versions of the newest
+// key ring and attempts blob (snapshot or log entry) after the change.
+// The newest blob thus describes the whole state.
+type stateEnvelope struct {
+	Kind     string `json:"kind"`
+	Version  uint64 `json:"version"`
+	Ring     uint64 `json:"ring"`
+	Attempts uint64 `json:"attempts"`
+	Data     []byte `json:"data"`
+}
+
+// sealFunc seals data as the given kind under the version of the change.
+type sealFunc func(kind string, data []byte) ([]byte, error)
+
+// sealedState seals the state the enclave keeps outside of it and
+// protects it against rollback: the version of the newest blob must match
+// the counter, and the newest blob names the key ring and attempts blobs
+// that belong to it.
+type sealedState struct {
+	Sealer
+	counter  Counter
+	mu       sync.Mutex
+	version  uint64
+	ring     uint64
+	attempts uint64
+	err      error
+	// countMu serializes the calls of the counter, counted is its value
+	countMu sync.Mutex
+	counted uint64
+}
+
+// update stores one change of the state. put is called with a sealFunc
+// for the next version and must store everything it seals; then the
+// counter is advanced to the version, and update returns once it is. A
+// crash in between leaves the state ahead of the counter, which start
+// accepts. If the counter fails the state is ahead of it and every later
+// update fails too.
+func (s *sealedState) update(kind string, put func(seal sealFunc) error) error {
+	return s.updateAt(kind, func(version uint64, seal sealFunc) error {
+		return put(seal)
+	})
+}
+
+// updateAt is update for a put that also needs the version of the change,
+// e.g. to record which blobs it sealed.
+func (s *sealedState) updateAt(kind string, put func(version uint64, seal sealFunc) error) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return s.err
+	}
+	next := stateEnvelope{Version: s.version + 1, Ring: s.ring, Attempts: s.attempts}
+	if kind == stateRing {
+		next.Ring = next.Version
+	} else {
+		next.Attempts = next.Version
+	}
+	seal := func(kind string, data []byte) ([]byte, error) {
+		envelope := next
+		envelope.Kind = kind
+		envelope.Data = data
+		jsonData, err := json.Marshal(envelope)
+		if err != nil {
+			return nil, err
+		}
+		return s.Seal(jsonData)
+	}
+	if err := put(next.Version, seal); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.version, s.ring, s.attempts = next.Version, next.Ring, next.Attempts
+	s.mu.Unlock()
+	return s.count(next.Version)
+}
+
+// count waits until the counter reaches version. s.mu is not held, so the
+// next changes are stored while the counter is called, and one call then
+// counts all of them.
+func (s *sealedState) count(version uint64) error {
+	s.countMu.Lock()
+	defer s.countMu.Unlock()
+	if s.counted >= version {
+		return nil
+	}
+	s.mu.Lock()
+	target, err := s.version, s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	value, err := s.counter.Advance(target)
+	if err == nil && value != target {
+		err = fmt.Errorf("counter is at %d, expected %d", value, target)
+	}
+	if err != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.err == nil {
+			s.err = fmt.Errorf("rollback counter: %v", err)
+		}
+		return s.err
+	}
+	s.counted = value
+	return nil
+}
+
+// open unseals a blob of the given kind. Blobs sealed before the envelope
+// was introduced are returned as they are, with version 0.
+func (s *sealedState) open(kind string, sealed []byte) ([]byte, stateEnvelope, error) {
+	data, err := s.Unseal(sealed)
+	if err != nil {
+		return nil, stateEnvelope{}, err
+	}
+	var envelope stateEnvelope
+	if err := json.Unmarshal(data, &envelope); err != nil || envelope.Kind == "" {
+		return data, stateEnvelope{}, nil
+	}
+	if envelope.Kind != kind {
+		return nil, stateEnvelope{}, fmt.Errorf("sealed %s found where %s was expected", envelope.Kind, kind)
+	}
+	return envelope.Data, envelope, nil
+}
+
+// start checks the state loaded by initialize. newest is the blob with the
+// highest version, ring and attempts are the versions of the key ring and
+// the last attempts blob that were loaded. It refuses a state older than
+// the counter and blobs that do not belong to the same state.
+func (s *sealedState) start(newest stateEnvelope, ring uint64, attempts uint64) error {
+	value, err := s.counter.Read()
+	if err != nil {
+		return err
+	}
+	switch {
+	case newest.Version > value:
+		// the enclave stopped between storing changes and counting them;
+		// none of them was acknowledged yet
+		if value, err = s.counter.Advance(newest.Version); err != nil {
+			return err
+		}
+		if value != newest.Version {
+			return fmt.Errorf("counter is at %d, expected %d", value, newest.Version)
+		}
+	case newest.Version < value:
+		return fmt.Errorf("sealed state has version %d but the counter is at %d, refusing to start on a stale state", newest.Version, value)
+	}
+	if newest.Ring != ring || newest.Attempts != attempts {
+		return errors.New("the sealed key ring and attempts are not from the same state, refusing to start on a stale state")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version, s.ring, s.attempts = newest.Version, ring, attempts
+	s.counted = value
+	return nil
+}
+
+// restart continues from the counter without loading a state, for the key
+// import which replaces the state the old enclave sealed.
+func (s *sealedState) restart() error {
+	value, err := s.counter.Read()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.version, s.ring, s.attempts = value, 0, 0
+	s.counted = value
+	return nil
+}
+
+// newer returns the envelope with the higher version.
+func newer(a stateEnvelope, b stateEnvelope) stateEnvelope {
+	if b.Version > a.Version {
+		return b
+	}
+	return a
+}
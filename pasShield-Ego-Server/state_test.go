@@ -0,0 +1,105 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// memoryCounter is a Counter for the tests, which start from an empty state
+// every time.
+type memoryCounter struct {
+	value uint64
+}
+
+func (c *memoryCounter) Read() (uint64, error) {
+	return atomic.LoadUint64(&c.value), nil
+}
+
+func (c *memoryCounter) Advance(value uint64) (uint64, error) {
+	for {
+		old := atomic.LoadUint64(&c.value)
+		if old >= value {
+			return old, nil
+		}
+		if atomic.CompareAndSwapUint64(&c.value, old, value) {
+			return value, nil
+		}
+	}
+}
+
+// gatedCounter holds every Advance until release is closed and counts
+// the calls.
+type gatedCounter struct {
+	memoryCounter
+	release chan struct{}
+	mu      sync.Mutex
+	calls   int
+}
+
+func (c *gatedCounter) Advance(value uint64) (uint64, error) {
+	<-c.release
+	c.mu.Lock()
+	c.calls++
+	c.mu.Unlock()
+	return c.memoryCounter.Advance(value)
+}
+
+// TestStateBatchesCounter checks that changes are stored while the counter
+// is called, and that the next call counts all of them.
+func TestStateBatchesCounter(t *testing.T) {
+	counter := &gatedCounter{release: make(chan struct{})}
+	state := &sealedState{Sealer: &softwareSealer{key: make([]byte, sealKeySize)}, counter: counter}
+	const changes = 8
+	stored := make(chan uint64, changes)
+	var wg sync.WaitGroup
+	for i := 0; i < changes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := state.updateAt(stateAttempts, func(version uint64, seal sealFunc) error {
+				stored <- version
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// every change is stored although the first call of the counter hangs
+	for i := 0; i < changes; i++ {
+		<-stored
+	}
+	close(counter.release)
+	wg.Wait()
+	if value, _ := counter.Read(); value != changes {
+		t.Errorf("counter is at %d, want %d", value, changes)
+	}
+	if counter.calls > 2 {
+		t.Errorf("%d changes took %d calls of the counter, want at most 2", changes, counter.calls)
+	}
+}
+
+// TestStateStartsAhead checks that start accepts a state several versions
+// ahead of the counter, after a crash before they were counted, but not one
+// behind it.
+func TestStateStartsAhead(t *testing.T) {
+	counter := &memoryCounter{value: 3}
+	state := &sealedState{Sealer: &softwareSealer{key: make([]byte, sealKeySize)}, counter: counter}
+	if err := state.start(stateEnvelope{Version: 6, Ring: 2, Attempts: 6}, 2, 6); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := counter.Read(); value != 6 {
+		t.Errorf("counter is at %d, want 6", value)
+	}
+	if err := state.update(stateRing, func(seal sealFunc) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := counter.Read(); value != 7 {
+		t.Errorf("counter is at %d, want 7", value)
+	}
+	stale := &sealedState{Sealer: state.Sealer, counter: counter}
+	if err := stale.start(stateEnvelope{Version: 6, Ring: 2, Attempts: 6}, 2, 6); err == nil {
+		t.Error("start accepted a state behind the counter")
+	}
+}
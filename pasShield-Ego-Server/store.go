@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a store if the requested record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+// ErrExists is returned by a store if the username to add already exists.
+var ErrExists = errors.New("username already exists")
+
+// UserStore keeps the per-user records: the hmac of the salted password
+// and the salt.
+type UserStore interface {
+	// AddSaltAndHmac adds a new user and returns ErrExists if the
+	// username already exists.
+	AddSaltAndHmac(username string, hmac string, salt []byte) error
+	// GetSaltAndHmac returns ErrNotFound if the username does not exist.
+	GetSaltAndHmac(username string) ([]byte, string, error)
+	// UpdateHmac replaces the stored hmac record of the user if it still
+	// equals old, and returns ErrNotFound otherwise.
+	UpdateHmac(username string, old string, new string) error
+	// ListRecords returns up to limit users ordered by username, starting
+	// after the given username ("" for the first page).
+	ListRecords(after string, limit int) ([]userRecord, error)
+}
+
+// userRecord is one row of the user records.
+type userRecord struct {
+	Username string
+	Hmac     string
+	Salt     []byte
+}
+
+// SessionStore keeps the login sessions, keyed by the hash of their token.
+type SessionStore interface {
+	// AddSession stores a new session.
+	AddSession(hash string, s session) error
+	// GetSession returns ErrNotFound if there is no session with the hash.
+	GetSession(hash string) (session, error)
+	// TouchSession sets the time the session was last used.
+	TouchSession(hash string, lastSeen time.Time) error
+	// DeleteSession returns ErrNotFound if there is no session with the
+	// hash.
+	DeleteSession(hash string) error
+	// DeleteUserSessions deletes every session of the user and returns how
+	// many there were.
+	DeleteUserSessions(username string) (int64, error)
+	// DeleteExpiredSessions deletes the sessions that expired at now or
+	// were last used before idleBefore, and returns how many there were.
+	DeleteExpiredSessions(now time.Time, idleBefore time.Time) (int64, error)
+}
+
+// StateStore keeps the sealed enclave state between restarts. It only ever
+// sees data that was sealed inside the enclave.
+type StateStore interface {
+	// GetSealedHmacKey returns ErrNotFound if no key was stored yet.
+	GetSealedHmacKey() ([]byte, error)
+	// PutSealedHmacKey replaces the stored key.
+	PutSealedHmacKey(sealed []byte) error
+	// GetSealedAttempts returns the sealed index of the attempt
+	// partitions, or ErrNotFound if it was not stored yet.
+	GetSealedAttempts() ([]byte, error)
+	// GetAttemptPartition returns the sealed row of a partition, or
+	// ErrNotFound.
+	GetAttemptPartition(id int) ([]byte, error)
+	// PutAttemptCheckpoint replaces the stored index and the given
+	// partition rows, deleting those that are nil, and drops the attempt
+	// log entries up to and including through, atomically.
+	PutAttemptCheckpoint(index []byte, partitions map[int][]byte, through int64) error
+	// AppendAttemptLog durably stores one sealed attempt log entry.
+	AppendAttemptLog(seq int64, entry []byte) error
+	// GetAttemptLog returns the sealed log entries after the given
+	// sequence number, in order.
+	GetAttemptLog(after int64) ([][]byte, error)
+}
+
+// Store is a database backend holding both the user records and the
+// sealed state.
+type Store interface {
+	UserStore
+	SessionStore
+	StateStore
+	Close() error
+}
+
+// newStore opens the store selected by name: "sqlite", "postgres" or
+// "memory". dsn is the sqlite file or the postgres connection string and
+// is ignored by the memory store.
+func newStore(name string, dsn string) (Store, error) {
+	switch name {
+	case "sqlite":
+		return newSQLStore("sqlite3", dsn)
+	case "postgres":
+		return newSQLStore("postgres", dsn)
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, errors.New("unknown store: " + name)
+	}
+}
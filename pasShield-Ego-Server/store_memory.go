@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps all records in memory. Nothing survives a restart, so
+// it is only useful for tests and development.
+type memoryStore struct {
+	mu             sync.Mutex
+	users          map[string]memoryUser
+	sessions       map[string]session
+	sealedHmacKey  []byte
+	sealedAttempts []byte
+	partitions     map[int][]byte
+	attemptLog     map[int64][]byte
+}
+
+type memoryUser struct {
+	hmac string
+	salt []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:      make(map[string]memoryUser),
+		sessions:   make(map[string]session),
+		partitions: make(map[int][]byte),
+		attemptLog: make(map[int64][]byte),
+	}
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) AddSaltAndHmac(username string, hmac string, salt []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[username]; ok {
+		return ErrExists
+	}
+	s.users[username] = memoryUser{hmac: hmac, salt: append([]byte(nil), salt...)}
+	return nil
+}
+
+func (s *memoryStore) GetSaltAndHmac(username string) ([]byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return append([]byte(nil), user.salt...), user.hmac, nil
+}
+
+func (s *memoryStore) AddSession(hash string, session session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[hash]; ok {
+		return errors.New("session already exists")
+	}
+	s.sessions[hash] = session
+	return nil
+}
+
+func (s *memoryStore) GetSession(hash string) (session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	found, ok := s.sessions[hash]
+	if !ok {
+		return session{}, ErrNotFound
+	}
+	return found, nil
+}
+
+func (s *memoryStore) TouchSession(hash string, lastSeen time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if found, ok := s.sessions[hash]; ok {
+		found.LastSeen = lastSeen
+		s.sessions[hash] = found
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteSession(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[hash]; !ok {
+		return ErrNotFound
+	}
+	delete(s.sessions, hash)
+	return nil
+}
+
+func (s *memoryStore) DeleteUserSessions(username string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for hash, found := range s.sessions {
+		if found.Username == username {
+			delete(s.sessions, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) DeleteExpiredSessions(now time.Time, idleBefore time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var deleted int64
+	for hash, found := range s.sessions {
+		if !now.Before(found.Expires) || found.LastSeen.Before(idleBefore) {
+			delete(s.sessions, hash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) UpdateHmac(username string, old string, new string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	user, ok := s.users[username]
+	if !ok || user.hmac != old {
+		return ErrNotFound
+	}
+	user.hmac = new
+	s.users[username] = user
+	return nil
+}
+
+func (s *memoryStore) ListRecords(after string, limit int) ([]userRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var usernames []string
+	for username := range s.users {
+		if username > after {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	if len(usernames) > limit {
+		usernames = usernames[:limit]
+	}
+	records := make([]userRecord, 0, len(usernames))
+	for _, username := range usernames {
+		user := s.users[username]
+		records = append(records, userRecord{Username: username, Hmac: user.hmac, Salt: append([]byte(nil), user.salt...)})
+	}
+	return records, nil
+}
+
+func (s *memoryStore) GetSealedHmacKey() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealedHmacKey == nil {
+		return nil, ErrNotFound
+	}
+	return s.sealedHmacKey, nil
+}
+
+func (s *memoryStore) PutSealedHmacKey(sealed []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealedHmacKey = sealed
+	return nil
+}
+
+func (s *memoryStore) GetSealedAttempts() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sealedAttempts == nil {
+		return nil, ErrNotFound
+	}
+	return s.sealedAttempts, nil
+}
+
+func (s *memoryStore) GetAttemptPartition(id int) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.partitions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryStore) PutAttemptCheckpoint(index []byte, partitions map[int][]byte, through int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sealedAttempts = index
+	for id, data := range partitions {
+		if data == nil {
+			delete(s.partitions, id)
+		} else {
+			s.partitions[id] = data
+		}
+	}
+	for seq := range s.attemptLog {
+		if seq <= through {
+			delete(s.attemptLog, seq)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) AppendAttemptLog(seq int64, entry []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.attemptLog[seq]; ok {
+		return errors.New("attempt log entry already exists")
+	}
+	s.attemptLog[seq] = entry
+	return nil
+}
+
+func (s *memoryStore) GetAttemptLog(after int64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var seqs []int64
+	for seq := range s.attemptLog {
+		if seq > after {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	entries := make([][]byte, len(seqs))
+	for i, seq := range seqs {
+		entries[i] = s.attemptLog[seq]
+	}
+	return entries, nil
+}
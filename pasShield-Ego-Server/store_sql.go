@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlStore stores the records in SQLite or PostgreSQL. Queries are written
+// with "?" placeholders and rewritten for postgres by rebind.
+type sqlStore struct {
+	db     *sql.DB
+	driver string
+}
+
+func newSQLStore(driver string, dsn string) (*sqlStore, error) {
+	database, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqlStore{db: database, driver: driver}
+	if err := migrate(database, driver); err != nil {
+		database.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// rebind rewrites "?" placeholders to "$1", "$2", ... for postgres.
+func (s *sqlStore) rebind(query string) string {
+	if s.driver != "postgres" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+		} else {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
+
+// Determine if username already exists in the
+// database if not add the three inputs to the database
+// if it does return an error message
+func (s *sqlStore) AddSaltAndHmac(username string, hmac string, salt []byte) error {
+	// one statement, so of two concurrent registrations the second one
+	// inserts nothing and gets ErrExists
+	result, err := s.db.Exec(s.rebind("INSERT INTO Hmac (username, hmac, salt) VALUES (?, ?, ?) ON CONFLICT (username) DO NOTHING"), username, hmac, salt)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrExists
+	}
+	return nil
+}
+
+// input username return salt and hmac.
+// Determine if username already exists in the database
+// if not  return ErrNotFound if it does return  salt and hmac.
+func (s *sqlStore) GetSaltAndHmac(username string) ([]byte, string, error) {
+	var salt []byte
+	var hmac string
+	err := s.db.QueryRow(s.rebind("SELECT hmac, salt FROM Hmac WHERE username = ?"), username).Scan(&hmac, &salt)
+	if err == sql.ErrNoRows {
+		return nil, "", ErrNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if salt == nil || hmac == "" {
+		return nil, "", ErrNotFound
+	}
+	return salt, hmac, nil
+}
+
+// session times are stored as unix nanoseconds
+func (s *sqlStore) AddSession(hash string, session session) error {
+	_, err := s.db.Exec(s.rebind("INSERT INTO session (token, username, created, last_seen, expires) VALUES (?, ?, ?, ?, ?)"),
+		hash, session.Username, session.Created.UnixNano(), session.LastSeen.UnixNano(), session.Expires.UnixNano())
+	return err
+}
+
+func (s *sqlStore) GetSession(hash string) (session, error) {
+	var found session
+	var created, lastSeen, expires int64
+	err := s.db.QueryRow(s.rebind("SELECT username, created, last_seen, expires FROM session WHERE token = ?"), hash).Scan(&found.Username, &created, &lastSeen, &expires)
+	if err == sql.ErrNoRows {
+		return session{}, ErrNotFound
+	}
+	if err != nil {
+		return session{}, err
+	}
+	found.Created, found.LastSeen, found.Expires = time.Unix(0, created), time.Unix(0, lastSeen), time.Unix(0, expires)
+	return found, nil
+}
+
+func (s *sqlStore) TouchSession(hash string, lastSeen time.Time) error {
+	_, err := s.db.Exec(s.rebind("UPDATE session SET last_seen = ? WHERE token = ?"), lastSeen.UnixNano(), hash)
+	return err
+}
+
+func (s *sqlStore) DeleteSession(hash string) error {
+	result, err := s.db.Exec(s.rebind("DELETE FROM session WHERE token = ?"), hash)
+	if err != nil {
+		return err
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) DeleteUserSessions(username string) (int64, error) {
+	result, err := s.db.Exec(s.rebind("DELETE FROM session WHERE username = ?"), username)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) DeleteExpiredSessions(now time.Time, idleBefore time.Time) (int64, error) {
+	result, err := s.db.Exec(s.rebind("DELETE FROM session WHERE expires <= ? OR last_seen < ?"), now.UnixNano(), idleBefore.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (s *sqlStore) UpdateHmac(username string, old string, new string) error {
+	result, err := s.db.Exec(s.rebind("UPDATE Hmac SET hmac = ? WHERE username = ? AND hmac = ?"), new, username, old)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) ListRecords(after string, limit int) ([]userRecord, error) {
+	rows, err := s.db.Query(s.rebind("SELECT username, hmac, salt FROM Hmac WHERE username > ? ORDER BY username LIMIT ?"), after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []userRecord
+	for rows.Next() {
+		var record userRecord
+		if err := rows.Scan(&record.Username, &record.Hmac, &record.Salt); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqlStore) GetSealedHmacKey() ([]byte, error) {
+	var sealed []byte
+	err := s.db.QueryRow("SELECT Hmackey FROM Sealed").Scan(&sealed)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return sealed, err
+}
+
+func (s *sqlStore) PutSealedHmacKey(sealed []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM Sealed"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO Sealed (Hmackey) VALUES (?)"), sealed); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) GetSealedAttempts() ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow("SELECT data FROM attempt_index WHERE id = 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *sqlStore) GetAttemptPartition(id int) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(s.rebind("SELECT data FROM attempt_partition WHERE id = ?"), id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (s *sqlStore) PutAttemptCheckpoint(index []byte, partitions map[int][]byte, through int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//the index is the only row of attempt_index
+	if _, err := tx.Exec("DELETE FROM attempt_index WHERE id = 1"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind("INSERT INTO attempt_index (id, data) VALUES (1, ?)"), index); err != nil {
+		return err
+	}
+	for id, data := range partitions {
+		if _, err := tx.Exec(s.rebind("DELETE FROM attempt_partition WHERE id = ?"), id); err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		if _, err := tx.Exec(s.rebind("INSERT INTO attempt_partition (id, data) VALUES (?, ?)"), id, data); err != nil {
+			return err
+		}
+	}
+	//the snapshot includes these log entries
+	if _, err := tx.Exec(s.rebind("DELETE FROM attempt_log WHERE seq <= ?"), through); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AppendAttemptLog(seq int64, entry []byte) error {
+	_, err := s.db.Exec(s.rebind("INSERT INTO attempt_log (seq, entry) VALUES (?, ?)"), seq, entry)
+	return err
+}
+
+func (s *sqlStore) GetAttemptLog(after int64) ([][]byte, error) {
+	rows, err := s.db.Query(s.rebind("SELECT entry FROM attempt_log WHERE seq > ? ORDER BY seq"), after)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries [][]byte
+	for rows.Next() {
+		var entry []byte
+		if err := rows.Scan(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestAddSaltAndHmacRace registers one username from many goroutines at
+// once: exactly one registration wins and all others get ErrExists. sqlite
+// serializes the writers anyway; postgres needs the single statement.
+func TestAddSaltAndHmacRace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sqlite, err := newSQLStore("sqlite3", filepath.Join(dir, "password.db")+"?_busy_timeout=10000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlite.Close()
+
+	for name, database := range map[string]Store{"sqlite": sqlite, "memory": newMemoryStore()} {
+		for round := 0; round < 20; round++ {
+			username := fmt.Sprintf("user%d", round)
+			const registrations = 16
+			errs := make(chan error, registrations)
+			start := make(chan struct{})
+			var wg sync.WaitGroup
+			for i := 0; i < registrations; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					<-start
+					errs <- database.AddSaltAndHmac(username, "record", []byte("salt"))
+				}()
+			}
+			close(start)
+			wg.Wait()
+			close(errs)
+			won := 0
+			for err := range errs {
+				switch err {
+				case nil:
+					won++
+				case ErrExists:
+				default:
+					t.Errorf("%s: a concurrent registration of %s failed with %v", name, username, err)
+				}
+			}
+			if won != 1 {
+				t.Errorf("%s: %d registrations of %s succeeded", name, won, username)
+			}
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the size of the stress run, e.g. go test -race -run Stress -args -stress.workers 32 -stress.ops 2000
+var (
+	stressWorkers  = flag.Int("stress.workers", 16, "concurrent goroutines of the stress test")
+	stressUsers    = flag.Int("stress.users", 200, "accounts the workers share")
+	stressOps      = flag.Int("stress.ops", 1000, "operations per worker")
+	stressCapacity = flag.Int("stress.capacity", 10, "bucket capacity")
+	// a small cache makes the workers load and evict partitions all the time
+	stressCache = flag.Int("stress.cache", 64, "attempt partitions kept in memory")
+)
+
+// TestStress drives the in-enclave state (attempt buckets and log, hmac
+// key ring, attestation token and guess limiters) from many goroutines at
+// once and checks that no attempt was lost or given twice and that the
+// sealed state restarts to the same buckets. Run it with the race detector to check the locking:
+//
+//	go test -race -run Stress
+func TestStress(t *testing.T) {
+	workers, users, ops, capacity, cache := stressWorkers, stressUsers, stressOps, stressCapacity, stressCache
+	if *workers < 1 || *users < 1 || *ops < 1 || *capacity < 1 || *cache < 1 {
+		t.Fatal("workers, users, ops, capacity and cache must be positive")
+	}
+
+	key := make([]byte, sealKeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	sealer := &softwareSealer{key: key}
+	counter := &memoryCounter{}
+	database := newMemoryStore()
+	// no attempt is regained during the run, so the accounting is exact
+	limits := bucketLimits{Capacity: *capacity, Refill: time.Hour}
+	keys, attempts, err := initialize(database, &sealedState{Sealer: sealer, counter: counter}, limits, nil, *cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := attempts.state
+
+	salts := make([]string, *users)
+	for i := range salts {
+		salts[i] = fmt.Sprintf("%x", generateRandomSalt(16))
+		if err := attempts.fill(salts[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token := &attestationToken{}
+	spec, err := parseLimiterSpec("reject,capacity=1000000,refill=1ms,v4=24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter := newLimiter("stress", spec)
+
+	taken := make([]int64, len(salts))
+	var denied, failed int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < *workers; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := mathrand.New(mathrand.NewSource(seed))
+			fail := func(err error) {
+				t.Error(err)
+				atomic.AddInt64(&failed, 1)
+			}
+			for i := 0; i < *ops; i++ {
+				switch n := random.Intn(100); {
+				case n < 60:
+					// login
+					j := random.Intn(len(salts))
+					_, err := attempts.take(salts[j])
+					switch err {
+					case nil:
+						atomic.AddInt64(&taken[j], 1)
+					case errNoAttempts:
+						atomic.AddInt64(&denied, 1)
+					default:
+						fail(err)
+					}
+					kid, current := keys.currentKey()
+					genHmac([]byte(salts[j]), current)
+					if _, err := keys.key(kid); err != nil {
+						// retired between the two reads, as a login can see it
+						continue
+					}
+				case n < 80:
+					if _, err := attempts.status(salts[random.Intn(len(salts))]); err != nil {
+						fail(err)
+					}
+					limiter.take(fmt.Sprintf("10.0.%d.0/24", random.Intn(4)))
+				case n < 90:
+					token.get()
+				case n < 95:
+					token.set(fmt.Sprintf("token %d", i))
+					keys.generations()
+				case n < 98:
+					// admin rotation and retirement
+					if _, err := keys.rotate(ringSaver(database, state)); err != nil {
+						fail(err)
+						continue
+					}
+					if generations := keys.generations(); len(generations) > 3 {
+						keys.retire(generations[0], ringSaver(database, state))
+					}
+				default:
+					if err := attempts.snapshot(); err != nil {
+						fail(err)
+					}
+				}
+			}
+		}(int64(w))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	if failed > 0 {
+		t.Fatalf("%d operations failed", failed)
+	}
+
+	// every attempt taken is gone from its bucket, and none was taken twice
+	for j, saltKey := range salts {
+		status, err := attempts.status(saltKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if taken[j] > int64(limits.Capacity) || int64(status.Tokens) != int64(limits.Capacity)-taken[j] {
+			t.Fatalf("bucket of salt %s has %d attempts left after %d of %d were taken", saltKey, status.Tokens, taken[j], limits.Capacity)
+		}
+	}
+
+	// the sealed state restarts to the same buckets and key ring
+	restartedKeys, restarted, err := initialize(database, &sealedState{Sealer: sealer, counter: counter}, limits, nil, *cache)
+	if err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	for _, saltKey := range salts {
+		before, err := attempts.status(saltKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		after, err := restarted.status(saltKey)
+		if err != nil {
+			t.Fatalf("restart: %v", err)
+		}
+		if after.Tokens != before.Tokens {
+			t.Fatalf("restart: bucket of salt %s has %d attempts left instead of %d", saltKey, after.Tokens, before.Tokens)
+		}
+	}
+	kid, _ := keys.currentKey()
+	if restartedKid, _ := restartedKeys.currentKey(); restartedKid != kid {
+		t.Fatalf("restart: current hmac key is %s instead of %s", restartedKid, kid)
+	}
+
+	var total int64
+	for _, n := range taken {
+		total += n
+	}
+	t.Logf("%d workers ran %d operations in %v: %d attempts taken, %d denied, state version %d, restart consistent",
+		*workers, *workers**ops, elapsed.Round(time.Millisecond), total, denied, counter.value)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// wrapProgress is the state of the last bulk wrap run. Inner counts the
+// wrapped records by the generation of their inner mac, which stays needed
+// until their users log in.
+type wrapProgress struct {
+	Running  bool           `json:"running"`
+	Key      string         `json:"key"`
+	Scanned  int            `json:"scanned"`
+	Wrapped  int            `json:"wrapped"`
+	Skipped  int            `json:"skipped"`
+	Failed   int            `json:"failed"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Inner    map[string]int `json:"inner,omitempty"`
+}
+
+// wrapJob wraps every record whose outermost hmac is not under the current
+// key as HMAC(k_new, HMAC(k_old, salted)). It runs inside the enclave and
+// does not need the passwords, so dormant accounts stop depending on the
+// old key alone without waiting for their users to log in. The inner mac
+// still needs the old key, so it cannot be retired before each wrapped
+// record is re-MACed by rekeyRecord when its user logs in.
+type wrapJob struct {
+	mu       sync.Mutex
+	progress wrapProgress
+}
+
+func (j *wrapJob) status() wrapProgress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	progress := j.progress
+	progress.Inner = make(map[string]int, len(j.progress.Inner))
+	for id, n := range j.progress.Inner {
+		progress.Inner[id] = n
+	}
+	return progress
+}
+
+// start runs the job in the background, batchSize records at a time.
+func (j *wrapJob) start(keys *keyRing, database UserStore, batchSize int) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.progress.Running {
+		return errors.New("a wrap run is already in progress")
+	}
+	kid, key := keys.currentKey()
+	j.progress = wrapProgress{Running: true, Key: kid, Started: time.Now(), Inner: make(map[string]int)}
+	go j.run(kid, key, database, batchSize)
+	return nil
+}
+
+func (j *wrapJob) run(kid string, key []byte, database UserStore, batchSize int) {
+	after := ""
+	for {
+		page, err := database.ListRecords(after, batchSize)
+		if err != nil {
+			fmt.Println(err)
+			break
+		}
+		var wrapped, skipped, failed int
+		inner := make(map[string]int)
+		for _, user := range page {
+			record, err := parseRecord(user.Hmac, user.Salt)
+			if err != nil {
+				failed++
+				continue
+			}
+			if record.outerKeyID() == kid {
+				skipped++
+				continue
+			}
+			newRecord, err := wrapRecord(record, kid, key)
+			if err != nil {
+				failed++
+				continue
+			}
+			// skipped if the user logged in and was re-keyed meanwhile
+			err = database.UpdateHmac(user.Username, user.Hmac, newRecord.String())
+			if err == ErrNotFound {
+				skipped++
+			} else if err != nil {
+				fmt.Println(err)
+				failed++
+			} else {
+				wrapped++
+				inner[record.KeyID]++
+			}
+		}
+
+		j.mu.Lock()
+		j.progress.Scanned += len(page)
+		j.progress.Wrapped += wrapped
+		j.progress.Skipped += skipped
+		j.progress.Failed += failed
+		for id, n := range inner {
+			j.progress.Inner[id] += n
+		}
+		j.mu.Unlock()
+
+		if len(page) < batchSize {
+			break
+		}
+		after = page[len(page)-1].Username
+	}
+
+	j.mu.Lock()
+	j.progress.Running = false
+	finished := time.Now()
+	j.progress.Finished = &finished
+	fmt.Printf("🔑 Wrapped %d records under hmac key %s\n", j.progress.Wrapped, kid)
+	if len(j.progress.Inner) > 0 {
+		fmt.Printf("🔑 Their inner macs still need hmac keys %v until their users log in\n", j.progress.Inner)
+	}
+	j.mu.Unlock()
+}
+
+// keyWrapHandler starts a bulk wrap of all records under the current key.
+// The optional batch query parameter sets the number of records per batch.
+func keyWrapHandler(keys *keyRing, database UserStore, job *wrapJob) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "Only POST requests are allowed", http.StatusBadRequest)
+			return
+		}
+		batchSize := adminPageSize
+		if batch := r.URL.Query().Get("batch"); batch != "" {
+			n, err := strconv.Atoi(batch)
+			if err != nil || n < 1 {
+				http.Error(w, "batch must be a positive number", http.StatusBadRequest)
+				return
+			}
+			batchSize = n
+		}
+		if err := job.start(keys, database, batchSize); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeJSON(w, job.status())
+	}
+}
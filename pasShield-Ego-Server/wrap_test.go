@@ -0,0 +1,141 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// wrapAll runs a wrap under the current key and waits for it to finish.
+func wrapAll(t *testing.T, keys *keyRing, database UserStore) wrapProgress {
+	job := &wrapJob{}
+	if err := job.start(keys, database, 1); err != nil {
+		t.Fatal(err)
+	}
+	for job.status().Running {
+		time.Sleep(time.Millisecond)
+	}
+	return job.status()
+}
+
+// loginRecord is the part of a successful login that touches the record: it
+// verifies pwd and moves the record to the current key and policy.
+func loginRecord(t *testing.T, username string, pwd string, keys *keyRing, policy recordPolicy, database UserStore) passwordRecord {
+	salt, stored, err := database.GetSaltAndHmac(username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := parseRecord(stored, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verifyPassword(username, pwd, record, keys); err != nil || !ok {
+		t.Fatalf("%s cannot log in (%v)", username, err)
+	}
+	if err := rekeyRecord(username, stored, pwd, record, keys, policy, database); err != nil {
+		t.Fatal(err)
+	}
+	if salt, stored, err = database.GetSaltAndHmac(username); err != nil {
+		t.Fatal(err)
+	}
+	if record, err = parseRecord(stored, salt); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// TestWrapDrainsOnLogin checks that a wrap leaves the old key needed by
+// the inner macs, and that a login re-MACs the record under the plain
+// current key so the old generation can be retired.
+func TestWrapDrainsOnLogin(t *testing.T) {
+	keys, err := newKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := recordPolicy{Alg: algHmacSHA256, Norm: "none"}
+	database := newMemoryStore()
+	salt := generateRandomSalt(16)
+	record, err := createRecord("alice", "password", salt, keys, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AddSaltAndHmac("alice", record.String(), salt); err != nil {
+		t.Fatal(err)
+	}
+	noSave := func(data []byte) error { return nil }
+	if _, err := keys.rotate(noSave); err != nil {
+		t.Fatal(err)
+	}
+
+	progress := wrapAll(t, keys, database)
+	if progress.Wrapped != 1 || progress.Inner["1"] != 1 {
+		t.Fatalf("wrap progress %+v, want one record whose inner mac needs key 1", progress)
+	}
+	status, err := keyUsage(keys, database)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Records["2"] != 1 || status.Needed["1"] != 1 {
+		t.Fatalf("after the wrap the records are %v and need %v", status.Records, status.Needed)
+	}
+
+	record = loginRecord(t, "alice", "password", keys, policy, database)
+	if record.KeyID != "2" || len(record.Wrap) > 0 || record.Version != recordVersion {
+		t.Errorf("login left the record %s", record.String())
+	}
+	if status, err = keyUsage(keys, database); err != nil {
+		t.Fatal(err)
+	}
+	if status.Needed["1"] != 0 {
+		t.Fatalf("key 1 is still needed by %d records after the login", status.Needed["1"])
+	}
+	if err := keys.retire("1", noSave); err != nil {
+		t.Fatal(err)
+	}
+	loginRecord(t, "alice", "password", keys, policy, database)
+}
+
+// TestWrapOldRecordBindsUsernameOnLogin checks that a version 0 record
+// stays without the username when it is wrapped, and is bound to it by
+// the next login.
+func TestWrapOldRecordBindsUsernameOnLogin(t *testing.T) {
+	keys, err := newKeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := recordPolicy{Alg: algHmacSHA256, Norm: "none"}
+	database := newMemoryStore()
+	salt := generateRandomSalt(16)
+	_, key := keys.currentKey()
+	if err := database.AddSaltAndHmac("bob", genHmac(salting("password", salt), key), salt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := keys.rotate(func(data []byte) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	wrapAll(t, keys, database)
+
+	// the wrapped record is version 2, whose mac does not cover the
+	// username, so a copy to another row still verifies
+	salt, stored, err := database.GetSaltAndHmac("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := parseRecord(stored, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != 2 || len(record.Wrap) != 1 {
+		t.Fatalf("wrapped record %s", stored)
+	}
+	if ok, _ := verifyPassword("mallory", "password", record, keys); !ok {
+		t.Error("a copied version 2 record no longer verifies, update the README")
+	}
+
+	record = loginRecord(t, "bob", "password", keys, policy, database)
+	if record.Version != recordVersion || len(record.Wrap) > 0 {
+		t.Fatalf("login left the record %s", record.String())
+	}
+	if ok, _ := verifyPassword("mallory", "password", record, keys); ok {
+		t.Error("the record is not bound to bob after the login")
+	}
+}
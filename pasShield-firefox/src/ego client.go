@@ -2,16 +2,22 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"syscall/js"
+	"time"
 
 	"github.com/edgelesssys/ego/attestation"
+	"gopkg.in/square/go-jose.v2/jwt"
 )
 
 // attestationProviderURL is the URL of the attestation provider
@@ -20,8 +26,114 @@ var (
 	attestationProviderURL = "https://shareduks.uks.attest.azure.net"
 	attestStatus           = false
 	result                 = ""
+
+	// localProviderKey is the PEM public key (attest.key.pub) of the server's
+	// local attester, base64 encoded so it can be set with
+	// -ldflags "-X main.localProviderKey=...". If it is set, tokens are
+	// verified against it instead of Azure Attestation.
+	localProviderKey = ""
 )
 
+// localIssuer is the issuer (iss) of tokens created by the local attester
+const localIssuer = "passhield-local-attestation"
+
+// Verifier checks an attestation token and returns the report it contains.
+type Verifier interface {
+	Verify(token string) (attestation.Report, error)
+}
+
+// azureVerifier verifies tokens of a Microsoft Azure Attestation provider.
+type azureVerifier struct {
+	providerURL string
+}
+
+func (v azureVerifier) Verify(token string) (attestation.Report, error) {
+	return attestation.VerifyAzureAttestationToken(token, v.providerURL)
+}
+
+// localClaims are the private claims of an attestation token. They use the
+// same names as the claims of Microsoft Azure Attestation.
+type localClaims struct {
+	Data            string `json:"x-ms-sgx-ehd"`
+	SecurityVersion uint   `json:"x-ms-sgx-svn"`
+	Debug           bool   `json:"x-ms-sgx-is-debuggable"`
+	UniqueID        string `json:"x-ms-sgx-mrenclave"`
+	SignerID        string `json:"x-ms-sgx-mrsigner"`
+	ProductID       uint   `json:"x-ms-sgx-product-id"`
+}
+
+// localVerifier verifies tokens of the server's local attester with its
+// public key. Such tokens are not backed by an SGX quote.
+type localVerifier struct {
+	key *rsa.PublicKey
+}
+
+func newLocalVerifier(encodedKey string) (*localVerifier, error) {
+	keyPEM, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("local provider key is not PEM encoded")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("local provider key is not an RSA key")
+	}
+	return &localVerifier{key: key}, nil
+}
+
+func (v *localVerifier) Verify(rawToken string) (attestation.Report, error) {
+	token, err := jwt.ParseSigned(rawToken)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+
+	var publicClaims jwt.Claims
+	var privateClaims localClaims
+	if err := token.Claims(v.key, &publicClaims, &privateClaims); err != nil {
+		return attestation.Report{}, err
+	}
+	if err := publicClaims.Validate(jwt.Expected{Issuer: localIssuer, Time: time.Now()}); err != nil {
+		return attestation.Report{}, err
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(privateClaims.Data)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	uniqueID, err := hex.DecodeString(privateClaims.UniqueID)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	signerID, err := hex.DecodeString(privateClaims.SignerID)
+	if err != nil {
+		return attestation.Report{}, err
+	}
+	productID := make([]byte, 16)
+	binary.LittleEndian.PutUint16(productID, uint16(privateClaims.ProductID))
+	return attestation.Report{
+		Data:            data,
+		SecurityVersion: privateClaims.SecurityVersion,
+		Debug:           privateClaims.Debug,
+		UniqueID:        uniqueID,
+		SignerID:        signerID,
+		ProductID:       productID,
+	}, nil
+}
+
+func newVerifier() (Verifier, error) {
+	if localProviderKey != "" {
+		return newLocalVerifier(localProviderKey)
+	}
+	return azureVerifier{providerURL: attestationProviderURL}, nil
+}
+
 func main() {
 	c := make(chan struct{}, 0)
 
@@ -43,11 +155,15 @@ func registerCallbacks() {
 			fmt.Printf("🆗 Loaded server attestation token from %s.\n", serverURL+"/token")
 
 			// Verify the attestation token.
-			report, err := attestation.VerifyAzureAttestationToken(string(tokenBytes), attestationProviderURL)
+			verifier, err := newVerifier()
+			if err != nil {
+				panic(err)
+			}
+			report, err := verifier.Verify(string(tokenBytes))
 			if err != nil {
 				panic(err)
 			}
-			fmt.Println("✅ Azure Attestation Token verified.")
+			fmt.Println("✅ Attestation Token verified.")
 
 			if err := verifyReportValues(report, report.SignerID); err != nil {
 				panic(err)
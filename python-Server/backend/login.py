@@ -4,27 +4,53 @@ from flask_login import LoginManager, login_user
 from werkzeug.security import check_password_hash
 
 from models import db, Users
-import sqlite3
+import json
+import os
+import ssl
+import urllib.error
+import urllib.request
 
 login = Blueprint('login', __name__, template_folder='../frontend/templates')
 login_manager = LoginManager()
 login_manager.init_app(login)
 
+# the enclave keeps the sessions; only the hash of a token is in its
+# database, so the token is checked through its /session endpoint
+ENCLAVE_URL = os.environ.get('PASSHIELD_URL', 'https://localhost:8080')
+# the enclave's certificate, taken from its verified attestation token
+ENCLAVE_CERT = os.environ.get('PASSHIELD_CERT')
+
+
+def enclave_request(method, path, token):
+    context = ssl.create_default_context(cafile=ENCLAVE_CERT)
+    # the certificate is self-signed for the enclave, not for a host name
+    context.check_hostname = False
+    req = urllib.request.Request(ENCLAVE_URL + path, method=method, headers={'Authorization': 'Bearer ' + token})
+    return urllib.request.urlopen(req, context=context, timeout=10)
+
+
+def session_user(token):
+    try:
+        with enclave_request('GET', '/session', token) as response:
+            return json.load(response).get('username')
+    except urllib.error.HTTPError as e:
+        if e.code == 401:
+            return None
+        raise
+
+
 @login.route('/login', methods=['GET', 'POST'])
 def show():
     if request.method == 'POST':
         username =  request.form.get('username')
         token = request.form.get('token')
         try: 
-            with sqlite3.connect('/home/azureuser/Desktop/pasShield-Ego-Server/data/password.db') as conn:
-                cur = conn.cursor()
-                cur.execute('SELECT * FROM Token WHERE username = ? AND Token = ?', (username, token))
-                user = cur.fetchone()
-                if user is not None:
-                    session['username'] = username
-                    return redirect(url_for('home.show', username=username) + '?success=login')
-                else: 
-                    return redirect(url_for('login.show') + '?error=user-not-found')
+            if token and session_user(token) == username:
+                session['username'] = username
+                session['token'] = token
+                return redirect(url_for('home.show', username=username) + '?success=login')
+            else: 
+                return redirect(url_for('login.show') + '?error=user-not-found')
         except: 
             return redirect(url_for('login.show') + '?error=unknown')
     else:
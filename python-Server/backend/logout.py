@@ -1,6 +1,8 @@
-from flask import Blueprint, url_for, redirect
+from flask import Blueprint, url_for, redirect, session
 from flask_login import LoginManager, login_required, logout_user
 
+from login import enclave_request
+
 logout = Blueprint('logout', __name__, template_folder='../frontend/templates')
 login_manager = LoginManager()
 login_manager.init_app(logout)
@@ -9,4 +11,11 @@ login_manager.init_app(logout)
 #@login_required
 def show():
     session.pop('username', None)
+    token = session.pop('token', None)
+    if token:
+        # end the session in the enclave too, not only the cookie
+        try:
+            enclave_request('POST', '/logout', token).close()
+        except Exception as e:
+            print(e)
     return redirect(url_for('login.show') + '?success=logged-out')